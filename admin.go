@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+const adminDropReason = "trace dropped by admin"
+
+// audit returns a log entry recording an admin action and who requested it
+func audit(r *http.Request, action string) *logrus.Entry {
+	return logrus.WithField("action", action).
+		WithField("remoteAddr", r.RemoteAddr).
+		WithField("userAgent", r.UserAgent())
+}
+
+// processTrace calls decide for a single trace, removing it from the
+// buffer if decide returns true. It returns whether the trace was in
+// the buffer and whether it was removed
+func (a *app) processTrace(traceID traces.TraceID, decide func(*traces.Trace, time.Time) bool) (bool, bool) {
+	a.processLock.Lock()
+	defer a.processLock.Unlock()
+
+	trace, ok := a.traceBuffer.Get(traceID)
+	if !ok {
+		return false, false
+	}
+	if !decide(trace, time.Now()) {
+		return true, false
+	}
+	tbm := a.traceBuffer.DeleteTrace(traceID)
+	spansInBuffer.Add(float64(tbm.SpanDelta))
+	tracesInBuffer.Add(float64(tbm.TraceDelta))
+	return true, true
+}
+
+// forceDecision evaluates a trace against the policy regardless of its
+// age or completeness, or retries sending it if already accepted
+func (a *app) forceDecision(trace *traces.Trace, now time.Time) bool {
+	if _, result := trace.Sample(); result != nil {
+		return a.resendTrace(trace, now)
+	}
+	return a.evaluateTrace(trace)
+}
+
+// dropTrace rejects a trace without evaluating it
+func (a *app) dropTrace(trace *traces.Trace, now time.Time) bool {
+	if _, result := trace.Sample(); result == nil {
+		a.logOverride(trace, false, &rules.SampleResult{SampleRate: 0, Reason: adminDropReason})
+		a.recordDecision(trace, false, adminDropReason)
+	}
+	logrus.WithField("trace", trace).Debug("dropping trace on admin request")
+	return true
+}
+
+// flushResponse is the response from the /admin/flush endpoint
+type flushResponse struct {
+	TracesBefore int `json:"tracesBefore"`
+	TracesAfter  int `json:"tracesAfter"`
+}
+
+// handleFlush handles the /admin/flush POST endpoint, processing the
+// trace buffer immediately rather than waiting for the next flush. With
+// all=true, every trace is decided on regardless of age or completeness
+// as by the decide endpoint, and accepted traces that can't be sent stay
+// in the buffer to be retried
+func (a *app) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+	response := flushResponse{TracesBefore: a.traceBuffer.Len()}
+	if all {
+		a.processTraces(a.forceDecision)
+	} else {
+		a.processSpans()
+	}
+	response.TracesAfter = a.traceBuffer.Len()
+	audit(r, "flush").
+		WithField("all", all).
+		WithField("tracesBefore", response.TracesBefore).
+		WithField("tracesAfter", response.TracesAfter).
+		Info("Admin flushed trace buffer")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// traceActionResponse is the response from the /admin/traces endpoints
+type traceActionResponse struct {
+	TraceID      string              `json:"traceId"`
+	Removed      bool                `json:"removed"`
+	Decision     *bool               `json:"decision,omitempty"`
+	SampleResult *rules.SampleResult `json:"sampleResult,omitempty"`
+}
+
+// handleTraceAction handles the /admin/traces/{traceId}/decide POST
+// endpoint, which decides on a trace now regardless of its age or
+// completeness, and the /admin/traces/{traceId} DELETE endpoint, which
+// drops a trace from the buffer without sending it
+func (a *app) handleTraceAction(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/traces/")
+	var action string
+	var decide func(*traces.Trace, time.Time) bool
+	switch {
+	case strings.HasSuffix(path, "/decide") && r.Method == http.MethodPost:
+		action, decide = "decide", a.forceDecision
+	case !strings.Contains(path, "/") && r.Method == http.MethodDelete:
+		action, decide = "drop", a.dropTrace
+	case strings.HasSuffix(path, "/decide") || !strings.Contains(path, "/"):
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown admin action " + r.URL.Path})
+		return
+	}
+	traceID := strings.TrimSuffix(path, "/decide")
+	var trace *traces.Trace
+	found, removed := a.processTrace(traces.TraceID(traceID), func(t *traces.Trace, now time.Time) bool {
+		trace = t
+		return decide(t, now)
+	})
+	entry := audit(r, action).WithField("traceID", traceID)
+	if !found {
+		entry.Warn("Admin action on trace not in the trace buffer")
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "trace " + traceID + " is not in the trace buffer"})
+		return
+	}
+	response := traceActionResponse{TraceID: traceID, Removed: removed}
+	if decision, result := trace.Sample(); result != nil {
+		response.Decision, response.SampleResult = &decision, result
+		entry = entry.WithField("decision", decision).WithField("reason", result.Reason)
+	}
+	entry.WithField("removed", removed).Info("Admin action on trace")
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleFlush(t *testing.T) {
+	a, destination := newTestApp(t, 100)
+	now := time.Now()
+	addTestTrace(a, "old", now.Add(-2*time.Minute), true)
+	addTestTrace(a, "recent", now, true)
+
+	w := httptest.NewRecorder()
+	a.handleFlush(w, httptest.NewRequest("POST", "/admin/flush", nil))
+	var response flushResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.TracesBefore != 2 || response.TracesAfter != 1 || len(destination.payloads) != 1 {
+		t.Errorf("Expected a normal flush to only send the old trace, got %+v", response)
+	}
+
+	destination.err = errors.New("sink full")
+	w = httptest.NewRecorder()
+	a.handleFlush(w, httptest.NewRequest("POST", "/admin/flush?all=true", nil))
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.TracesBefore != 1 || response.TracesAfter != 1 {
+		t.Errorf("Expected flushing all traces to keep a trace that couldn't be sent, got %+v", response)
+	}
+
+	destination.err = nil
+	w = httptest.NewRecorder()
+	a.handleFlush(w, httptest.NewRequest("POST", "/admin/flush?all=true", nil))
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.TracesBefore != 1 || response.TracesAfter != 0 || len(destination.payloads) != 2 {
+		t.Errorf("Expected flushing all traces to send the recent trace, got %+v", response)
+	}
+
+	w = httptest.NewRecorder()
+	a.handleFlush(w, httptest.NewRequest("GET", "/admin/flush", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", w.Code)
+	}
+}
+
+func TestHandleTraceAction(t *testing.T) {
+	a, destination := newTestApp(t, 100)
+	now := time.Now()
+	addTestTrace(a, "incomplete", now, false)
+	addTestTrace(a, "unwanted", now, true)
+
+	w := httptest.NewRecorder()
+	a.handleTraceAction(w, httptest.NewRequest("POST", "/admin/traces/incomplete/decide", nil))
+	var response traceActionResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || !response.Removed || response.Decision == nil || !*response.Decision || response.SampleResult.Reason != "test policy" {
+		t.Errorf("Expected the incomplete trace to be evaluated and sent, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(destination.payloads) != 1 {
+		t.Errorf("Expected the decided trace to be sent")
+	}
+
+	w = httptest.NewRecorder()
+	a.handleTraceAction(w, httptest.NewRequest("DELETE", "/admin/traces/unwanted", nil))
+	response = traceActionResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || !response.Removed || response.Decision != nil {
+		t.Errorf("Expected the trace to be dropped, got %d: %s", w.Code, w.Body.String())
+	}
+	if a.traceBuffer.Len() != 0 || len(destination.payloads) != 1 {
+		t.Errorf("Dropped trace should be removed without being sent")
+	}
+
+	for request, status := range map[[2]string]int{
+		{"DELETE", "/admin/traces/unwanted"}:       http.StatusNotFound,
+		{"POST", "/admin/traces/unknown/decide"}:   http.StatusNotFound,
+		{"GET", "/admin/traces/unknown/decide"}:    http.StatusMethodNotAllowed,
+		{"POST", "/admin/traces/unknown"}:          http.StatusMethodNotAllowed,
+		{"POST", "/admin/traces/unknown/teleport"}: http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		a.handleTraceAction(w, httptest.NewRequest(request[0], request[1], nil))
+		if w.Code != status {
+			t.Errorf("Expected %d for %s %s, got %d", status, request[0], request[1], w.Code)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+var (
+	circuitStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otre_destination_circuit_state",
+		Help: "The state of a destination's circuit breaker: 0 closed, 1 half-open, 2 open",
+	}, []string{"destination"})
+	circuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_destination_circuit_transitions_total",
+		Help: "The total number of times a destination's circuit breaker changed state",
+	}, []string{"destination", "state"})
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// CircuitBreaker stops sending to a destination after FailureThreshold
+// consecutive failures. Once OpenTimeout has passed, a single probe is
+// let through, closing the circuit again if it succeeds
+type CircuitBreaker struct {
+	Name             string
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+	sync.Mutex
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker for a destination
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	b := new(CircuitBreaker)
+	b.Name = name
+	b.FailureThreshold = failureThreshold
+	b.OpenTimeout = openTimeout
+	b.now = time.Now
+	circuitStateGauge.WithLabelValues(name).Set(float64(circuitClosed))
+	return b
+}
+
+// newCircuitBreaker creates a CircuitBreaker for a destination
+// using the configured failure threshold and open timeout
+func (a *app) newCircuitBreaker(name string) *CircuitBreaker {
+	return NewCircuitBreaker(name, a.circuitFailureThreshold, a.circuitOpenTimeout)
+}
+
+func (b *CircuitBreaker) transition(state circuitState) {
+	if b.state == state {
+		return
+	}
+	logrus.WithField("destination", b.Name).WithField("state", state).Info("Circuit breaker changed state")
+	b.state = state
+	b.probing = false
+	if state == circuitOpen {
+		b.openedAt = b.now()
+	}
+	circuitStateGauge.WithLabelValues(b.Name).Set(float64(state))
+	circuitTransitions.WithLabelValues(b.Name, state.String()).Inc()
+}
+
+// Allow returns whether a request may be sent. When the circuit is
+// half-open only one probe request is allowed until its outcome is known
+func (b *CircuitBreaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == circuitOpen && b.now().Sub(b.openedAt) >= b.OpenTimeout {
+		b.transition(circuitHalfOpen)
+	}
+	switch b.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Success records a successful request, closing the circuit
+func (b *CircuitBreaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+	b.transition(circuitClosed)
+}
+
+// Failure records a failed request, opening the circuit if the
+// failure threshold is reached or a probe fails
+func (b *CircuitBreaker) Failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.FailureThreshold {
+		b.transition(circuitOpen)
+	}
+}
+
+// Open returns whether the circuit is currently refusing requests. An
+// open circuit that is due a probe is not considered open, so that a
+// destination that is not ready can still receive the probe
+func (b *CircuitBreaker) Open() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state == circuitOpen && b.now().Sub(b.openedAt) < b.OpenTimeout
+}
+
+// State returns the name of the current state of the circuit
+func (b *CircuitBreaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.state.String()
+}
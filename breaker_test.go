@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2020, time.January, 8, 9, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker("test", 2, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if !b.Allow() || b.Open() {
+		t.Errorf("Circuit should stay closed below the failure threshold")
+	}
+	b.Failure()
+	if b.Allow() || !b.Open() {
+		t.Errorf("Circuit should open at the failure threshold")
+	}
+
+	now = now.Add(time.Second)
+	if b.Open() {
+		t.Errorf("Circuit due a probe should not be considered open")
+	}
+	if !b.Allow() {
+		t.Errorf("Circuit should allow a probe after the open timeout")
+	}
+	if b.State() != "half-open" || b.Allow() {
+		t.Errorf("Half-open circuit should only allow a single probe")
+	}
+	b.Failure()
+	if b.State() != "open" || b.Allow() {
+		t.Errorf("Failed probe should reopen the circuit")
+	}
+
+	now = now.Add(time.Second)
+	b.Allow()
+	b.Success()
+	if b.State() != "closed" || !b.Allow() {
+		t.Errorf("Successful probe should close the circuit")
+	}
+	b.Failure()
+	if b.Open() {
+		t.Errorf("Closing the circuit should reset the failure count")
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	collector := &Forwarder{Breaker: NewCircuitBreaker("collector", 1, time.Minute)}
+	kafka := &KafkaForwarder{Breaker: NewCircuitBreaker("kafka", 1, time.Minute)}
+	a := &app{destinations: []Destination{collector, kafka}}
+
+	w := httptest.NewRecorder()
+	a.handleReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("otre should be ready when all circuits are closed, got %d", w.Code)
+	}
+
+	kafka.Breaker.Failure()
+	w = httptest.NewRecorder()
+	a.handleReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("otre should not be ready when a circuit is open, got %d", w.Code)
+	}
+	var circuits map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&circuits); err != nil {
+		t.Fatalf("Couldn't decode readiness response: %v", err)
+	}
+	if circuits["collector"] != "closed" || circuits["kafka"] != "open" {
+		t.Errorf("Readiness response should report each circuit's state, got %v", circuits)
+	}
+}
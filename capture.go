@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	capturedSpans = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_capture_spans_total",
+		Help: "The total number of received spans written to capture files",
+	})
+	captureDroppedSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_capture_dropped_spans_total",
+		Help: "The total number of received spans not written to capture files by reason",
+	}, []string{"reason"})
+)
+
+// captureRecord is a batch of spans as received by handleSpans, along
+// with when, where and in what format they were received, so that the
+// capture can be replayed with otre replay --format capture
+type captureRecord struct {
+	ReceivedAt  time.Time    `json:"receivedAt"`
+	Endpoint    string       `json:"endpoint"`
+	Format      string       `json:"format"`
+	ContentType string       `json:"contentType"`
+	Spans       []types.Span `json:"spans"`
+}
+
+// captureFormat returns the replay format of spans received at an endpoint
+func captureFormat(endpoint string) string {
+	if strings.HasPrefix(endpoint, "/api/v1/") {
+		return "zipkin-v1"
+	}
+	return "zipkin-v2"
+}
+
+// Capture writes received spans to JSONL files, starting a new file
+// once the current one reaches MaxSize bytes and keeping at most
+// MaxFiles older files. Spans are only captured from the listed
+// Services, if any, and at no more than Rate spans per second
+type Capture struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	Rate     float64
+	Services map[string]bool
+
+	file   *os.File
+	size   int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sync.Mutex
+}
+
+// NewCapture creates a Capture writing to path
+func NewCapture(path string, maxSize int64, maxFiles int, rate float64, services string) *Capture {
+	c := new(Capture)
+	c.Path = path
+	c.MaxSize = maxSize
+	c.MaxFiles = maxFiles
+	c.Rate = rate
+	c.Services = make(map[string]bool)
+	for _, service := range strings.Split(services, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			c.Services[service] = true
+		}
+	}
+	c.now = time.Now
+	c.tokens = rate
+	c.last = c.now()
+	return c
+}
+
+// rotatedPath returns the name of the nth older capture file,
+// keeping the extension so that rotated files are still JSONL
+func (c *Capture) rotatedPath(n int) string {
+	ext := filepath.Ext(c.Path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(c.Path, ext), n, ext)
+}
+
+// rotate closes the current capture file and shifts the older files
+// along, removing the oldest once there are MaxFiles of them
+func (c *Capture) rotate() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	os.Remove(c.rotatedPath(c.MaxFiles))
+	for n := c.MaxFiles - 1; n > 0; n-- {
+		os.Rename(c.rotatedPath(n), c.rotatedPath(n+1))
+	}
+	if c.MaxFiles > 0 {
+		return os.Rename(c.Path, c.rotatedPath(1))
+	}
+	return os.Remove(c.Path)
+}
+
+// allow returns whether n spans are within the rate limit. The limit
+// allows bursts of up to a second's worth of spans
+func (c *Capture) allow(n int) bool {
+	if c.Rate <= 0 {
+		return true
+	}
+	now := c.now()
+	c.tokens += now.Sub(c.last).Seconds() * c.Rate
+	if c.tokens > c.Rate {
+		c.tokens = c.Rate
+	}
+	c.last = now
+	if c.tokens <= 0 {
+		return false
+	}
+	c.tokens -= float64(n)
+	return true
+}
+
+func (c *Capture) write(line []byte) error {
+	if c.file != nil && c.size > 0 && c.size+int64(len(line)) > c.MaxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	if c.file == nil {
+		f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		c.file, c.size = f, info.Size()
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+// Record writes the spans received at an endpoint to the capture file
+func (c *Capture) Record(endpoint, contentType string, spans []*types.Span) {
+	record := captureRecord{
+		Endpoint:    endpoint,
+		Format:      captureFormat(endpoint),
+		ContentType: contentType,
+	}
+	for _, span := range spans {
+		if len(c.Services) == 0 || c.Services[span.ServiceName] {
+			record.Spans = append(record.Spans, *span)
+		}
+	}
+	if len(record.Spans) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if !c.allow(len(record.Spans)) {
+		captureDroppedSpans.WithLabelValues("rate_limit").Add(float64(len(record.Spans)))
+		return
+	}
+	record.ReceivedAt = c.now()
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = c.write(append(line, '\n'))
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("captureFile", c.Path).Warn("Error writing capture file")
+		captureDroppedSpans.WithLabelValues("error").Add(float64(len(record.Spans)))
+		return
+	}
+	capturedSpans.Add(float64(len(record.Spans)))
+}
+
+// Close closes the current capture file
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+func captureSpans(service string, n int) []*types.Span {
+	spans := make([]*types.Span, n)
+	for i := range spans {
+		spans[i] = &types.Span{
+			CoreSpanMetadata:  types.CoreSpanMetadata{TraceID: service, ID: service + string(rune('a'+i)), ServiceName: service},
+			BinaryAnnotations: map[string]interface{}{},
+		}
+	}
+	return spans
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	captureFile := path.Join(dir, "capture.jsonl")
+	c := NewCapture(captureFile, 1<<20, 2, 0, "web, api")
+	c.Record("/api/v1/spans", "application/json", append(captureSpans("web", 2), captureSpans("db", 1)...))
+	c.Record("/api/v2/spans", "application/json", captureSpans("db", 3))
+	c.Close()
+
+	spans, err := readSpans(captureFile, "capture")
+	if err != nil || len(spans) != 2 {
+		t.Fatalf("Only spans from the listed services should be captured, got %d spans (%v)", len(spans), err)
+	}
+	if spans[0].ServiceName != "web" {
+		t.Errorf("Captured span should be replayed unchanged, got service %s", spans[0].ServiceName)
+	}
+
+	c = NewCapture(captureFile, 1, 2, 0, "")
+	for i := 0; i < 4; i++ {
+		c.Record("/api/v2/spans", "application/json", captureSpans("api", 1))
+	}
+	c.Close()
+	for _, file := range []string{captureFile, path.Join(dir, "capture.1.jsonl"), path.Join(dir, "capture.2.jsonl")} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("Expected capture file %s after rotation: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "capture.3.jsonl")); err == nil {
+		t.Errorf("Only the configured number of rotated capture files should be kept")
+	}
+}
+
+func TestCaptureRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	captureFile := path.Join(dir, "capture.jsonl")
+	now := time.Now()
+	c := NewCapture(captureFile, 1<<20, 1, 2, "")
+	c.now = func() time.Time { return now }
+	c.last = now
+	c.Record("/api/v2/spans", "application/json", captureSpans("web", 2))
+	c.Record("/api/v2/spans", "application/json", captureSpans("api", 2))
+	now = now.Add(time.Second)
+	c.Record("/api/v2/spans", "application/json", captureSpans("db", 2))
+	c.Close()
+
+	spans, err := readSpans(captureFile, "capture")
+	if err != nil || len(spans) != 4 {
+		t.Errorf("Spans over the rate limit should be dropped, got %d spans (%v)", len(spans), err)
+	}
+}
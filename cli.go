@@ -5,55 +5,214 @@ import (
 	"github.com/Sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/willthames/otre/decisionlog"
 	"github.com/willthames/otre/rules"
 	"github.com/willthames/otre/traces"
 )
 
 type app struct {
-	port         int
-	metricsPort  int
-	server       *http.Server
-	flushAge     time.Duration
-	flushTimeout time.Duration
-	abandonAge   time.Duration
-	collectorURL string
-	traceBuffer  *traces.TraceBuffer
-	re           rules.RulesEngine
-	forwarder    *Forwarder
-	logLevel     string
+	port                    int
+	metricsPort             int
+	server                  *http.Server
+	metricsServer           *http.Server
+	flushAge                time.Duration
+	flushTimeout            time.Duration
+	abandonAge              time.Duration
+	shutdownTimeout         time.Duration
+	shutdownIncomplete      string
+	collectorURL            string
+	mirrorURL               string
+	kafkaBrokers            string
+	kafkaTopic              string
+	kafkaEncoding           string
+	kafkaCompression        string
+	kafkaAcks               string
+	honeycombAPIHost        string
+	honeycombDataset        string
+	honeycombWriteKey       string
+	honeycombBatchSize      uint
+	honeycombBatchTimeout   time.Duration
+	honeycombRetries        int
+	traceBuffer             *traces.TraceBuffer
+	re                      *rules.RulesEngine
+	policyFile              string
+	policyHash              string
+	policyRevision          string
+	policyError             string
+	policyBundleURL         string
+	policyBundleETag        string
+	policyVerifier          *rules.Verifier
+	policyTimeout           time.Duration
+	policyFallback          *rules.SampleResult
+	policyInput             rules.InputFormat
+	shadow                  *rules.RulesEngine
+	shadowPolicyFile        string
+	shadowHash              string
+	shadowFailedHash        string
+	shadowError             error
+	shadowLogSample         float64
+	policyLock              sync.Mutex
+	policyWatchInterval     time.Duration
+	destinations            []Destination
+	circuitFailureThreshold int
+	circuitOpenTimeout      time.Duration
+	mirror                  *Forwarder
+	capture                 *Capture
+	decisionLog             *decisionlog.Logger
+	tail                    *decisionlog.Tail
+	tailBuffer              int
+	reasonLabels            *labelLimiter
+	shadowReasonLabels      *labelLimiter
+	serviceLabels           *labelLimiter
+	logLevel                string
+	done                    chan struct{}
+	processLock             sync.Mutex
 }
 
 func cliParse() *app {
 	port := flag.Int("port", 8080, "server port")
-	metricsPort := flag.Int("metrics-port", 10010, "prometheus /metrics port")
+	metricsPort := flag.Int("metrics-port", 10010, "prometheus /metrics and admin endpoints port")
 	flushAge := flag.Int("flush-age", 30000, "Interval in ms between trace flushes")
 	flushTimeout := flag.Int("flush-timeout", 600000, "Drop traces older than timeout if not successfully forwarded to collector")
 	abandonAge := flag.Int("abandon-age", 300000, "Age in ms after which incomplete trace is flushed")
+	shutdownTimeout := flag.Int("shutdown-timeout", 25000, "Maximum time in ms to spend flushing traces on shutdown")
+	shutdownIncomplete := flag.String("shutdown-incomplete", "evaluate", "What to do with incomplete traces on shutdown: accept, reject or evaluate against the policy")
 	collectorURL := flag.String("collector-url", "", "Host to forward traces. Not setting this will work as dry run")
-	policyFile := flag.String("policy-file", "", "policy definition file")
+	circuitFailureThreshold := flag.Int("circuit-failure-threshold", 5, "Consecutive failures after which sending to a destination is suspended")
+	circuitOpenTimeout := flag.Int("circuit-open-timeout", 10000, "Interval in ms after which a suspended destination is probed again")
+	mirrorURL := flag.String("mirror-url", "", "Host to mirror every inbound request to, before sampling")
+	kafkaBrokers := flag.String("kafka-brokers", "", "Comma separated list of kafka brokers to send traces to")
+	kafkaTopic := flag.String("kafka-topic", "otre", "kafka topic for traces")
+	kafkaEncoding := flag.String("kafka-encoding", "json", "kafka message encoding, json for one message per trace, json-span for one message per span")
+	kafkaCompression := flag.String("kafka-compression", "none", "kafka compression: none, gzip, snappy, lz4 or zstd")
+	kafkaAcks := flag.String("kafka-acks", "leader", "kafka acks required: none, leader or all")
+	honeycombAPIHost := flag.String("honeycomb-api-host", "https://api.honeycomb.io/", "honeycomb API host")
+	honeycombDataset := flag.String("honeycomb-dataset", "", "honeycomb dataset to send spans to. Not setting this disables sending to honeycomb")
+	honeycombWriteKey := flag.String("honeycomb-write-key", os.Getenv("HONEYCOMB_WRITE_KEY"), "honeycomb write key, defaults to $HONEYCOMB_WRITE_KEY")
+	honeycombBatchSize := flag.Uint("honeycomb-batch-size", 50, "maximum number of events in a honeycomb batch")
+	honeycombBatchTimeout := flag.Int("honeycomb-batch-timeout", 100, "Interval in ms after which a partial honeycomb batch is sent")
+	honeycombRetries := flag.Int("honeycomb-retries", 3, "number of times to retry sending an event to honeycomb, waiting 100ms before the first retry and twice as long before each further retry")
+	policyFile := flag.String("policy-file", "", "policy definition: a rego file, a directory of rego and data files, or an OPA bundle tarball")
+	policyWatchInterval := flag.Int("policy-watch-interval", 10000, "Interval in ms between checks for changes to the policy file or bundle. 0 disables watching")
+	policyBundleURL := flag.String("policy-bundle-url", "", "URL of an OPA bundle to download the policy from, instead of --policy-file")
+	policyBundleKey := flag.String("policy-bundle-key", "", "file containing the key used to verify bundle signatures. Not setting this accepts unsigned bundles")
+	policyBundleAlgorithm := flag.String("policy-bundle-algorithm", "RS256", "bundle signing algorithm: RS256 with a PEM public key or HS256 with a shared secret")
+	policyTimeout := flag.Int("policy-timeout", 1000, "Time in ms after which evaluating a trace against the policy is abandoned. 0 disables the timeout")
+	policyFallback := flag.String("policy-fallback", "accept", "decision when evaluating the policy fails or times out: accept, reject or a sample rate between 0 and 100")
+	policyInput := flag.String("policy-input", string(rules.DefaultInputFormat), "policy input format: structured, an object of the trace's spans, summary and span tree, or spans, the array of spans used by older policies")
+	shadowPolicyFile := flag.String("shadow-policy-file", "", "candidate policy evaluated alongside the active policy without affecting decisions")
+	shadowLogSample := flag.Float64("shadow-log-sample", 0.01, "Proportion of traces on which the shadow policy disagrees to log")
+	metricsMaxReasons := flag.Int("metrics-max-reasons", 50, "maximum number of distinct sample reasons in metric labels for each of the active and shadow policies, further reasons are counted as other")
+	metricsMaxServices := flag.Int("metrics-max-services", 100, "maximum number of distinct root services in metric labels, further services are counted as other")
+	decisionLog := flag.String("decision-log", "", "Where to write the decision log: stdout, an http(s) URL or a JSONL file. Not setting this disables the decision log")
+	decisionLogSample := flag.Float64("decision-log-sample", 1, "Proportion of decisions to write to the decision log")
+	decisionTailBuffer := flag.Int("decision-tail-buffer", 1000, "number of decisions buffered for each client tailing decisions, further decisions are dropped until the client catches up")
+	captureFile := flag.String("capture-file", "", "JSONL file to capture received spans to for later replay. Not setting this disables capture")
+	captureMaxSize := flag.Int("capture-max-size", 100, "Size in MB after which the capture file is rotated")
+	captureMaxFiles := flag.Int("capture-max-files", 5, "number of rotated capture files to keep")
+	captureRate := flag.Float64("capture-rate", 1000, "maximum number of spans per second to capture. 0 disables the limit")
+	captureServices := flag.String("capture-services", "", "Comma separated list of services to capture spans from. Not setting this captures all services")
 	logLevel := flag.String("log-level", "Info", "log level")
 
 	flag.Parse()
 
-	if *policyFile == "" {
-		logrus.Fatal("--policy-file argument is mandatory")
+	if err := validShutdownIncomplete(*shutdownIncomplete); err != nil {
+		logrus.Fatal(err)
 	}
-	policy, err := ioutil.ReadFile(*policyFile)
+	if (*policyFile == "") == (*policyBundleURL == "") {
+		logrus.Fatal("exactly one of --policy-file or --policy-bundle-url is mandatory")
+	}
+	if *decisionTailBuffer < 1 {
+		logrus.Fatal("--decision-tail-buffer must be at least 1")
+	}
+	fallback, err := rules.ParseFallback(*policyFallback)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	inputFormat, err := rules.ParseInputFormat(*policyInput)
 	if err != nil {
-		panic(err)
+		logrus.Fatal(err)
+	}
+	var verifier *rules.Verifier
+	if *policyBundleKey != "" {
+		key, err := ioutil.ReadFile(*policyBundleKey)
+		if err == nil {
+			verifier, err = rules.NewVerifier(*policyBundleAlgorithm, key)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("policyBundleKey", *policyBundleKey).Fatal("Error loading bundle verification key")
+		}
 	}
 	a := &app{
-		port:         *port,
-		metricsPort:  *metricsPort,
-		flushAge:     time.Duration(int64(*flushAge * 1E6)),
-		abandonAge:   time.Duration(int64(*abandonAge * 1E6)),
-		flushTimeout: time.Duration(int64(*flushTimeout * 1E6)),
-		collectorURL: *collectorURL,
-		logLevel:     *logLevel,
-		traceBuffer:  traces.NewTraceBuffer(),
-		re:           *rules.NewRulesEngine(string(policy)),
+		port:                    *port,
+		metricsPort:             *metricsPort,
+		flushAge:                time.Duration(int64(*flushAge * 1e6)),
+		abandonAge:              time.Duration(int64(*abandonAge * 1e6)),
+		flushTimeout:            time.Duration(int64(*flushTimeout * 1e6)),
+		shutdownTimeout:         time.Duration(int64(*shutdownTimeout * 1e6)),
+		shutdownIncomplete:      *shutdownIncomplete,
+		collectorURL:            *collectorURL,
+		circuitFailureThreshold: *circuitFailureThreshold,
+		circuitOpenTimeout:      time.Duration(int64(*circuitOpenTimeout * 1e6)),
+		mirrorURL:               *mirrorURL,
+		kafkaBrokers:            *kafkaBrokers,
+		kafkaTopic:              *kafkaTopic,
+		kafkaEncoding:           *kafkaEncoding,
+		kafkaCompression:        *kafkaCompression,
+		kafkaAcks:               *kafkaAcks,
+		honeycombAPIHost:        *honeycombAPIHost,
+		honeycombDataset:        *honeycombDataset,
+		honeycombWriteKey:       *honeycombWriteKey,
+		honeycombBatchSize:      *honeycombBatchSize,
+		honeycombBatchTimeout:   time.Duration(int64(*honeycombBatchTimeout * 1e6)),
+		honeycombRetries:        *honeycombRetries,
+		logLevel:                *logLevel,
+		traceBuffer:             traces.NewTraceBuffer(),
+		policyFile:              *policyFile,
+		policyBundleURL:         *policyBundleURL,
+		policyVerifier:          verifier,
+		policyWatchInterval:     time.Duration(int64(*policyWatchInterval * 1e6)),
+		shadowPolicyFile:        *shadowPolicyFile,
+		policyTimeout:           time.Duration(int64(*policyTimeout * 1e6)),
+		policyFallback:          &fallback,
+		policyInput:             inputFormat,
+		shadowLogSample:         *shadowLogSample,
+		reasonLabels:            newLabelLimiter(*metricsMaxReasons),
+		shadowReasonLabels:      newLabelLimiter(*metricsMaxReasons),
+		serviceLabels:           newLabelLimiter(*metricsMaxServices),
+		tail:                    decisionlog.NewTail(),
+		tailBuffer:              *decisionTailBuffer,
+	}
+	if *decisionLog != "" {
+		sink, err := decisionlog.NewSink(*decisionLog)
+		if err != nil {
+			logrus.WithError(err).WithField("decisionLog", *decisionLog).Fatal("Error opening decision log")
+		}
+		a.decisionLog = decisionlog.NewLogger(sink, *decisionLogSample)
+	}
+	if *captureFile != "" {
+		a.capture = NewCapture(*captureFile, int64(*captureMaxSize)<<20, *captureMaxFiles, *captureRate, *captureServices)
+	}
+	policy, etag, err := a.loadPolicy()
+	if err == nil {
+		a.re, err = rules.NewInputRulesEngine(policy, a.policyInput)
+	}
+	if err == nil {
+		a.configureEngine(a.re, "active")
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("policy", a.policySource()).Fatal("Error loading policy")
+	}
+	a.activatePolicy(policy.Hash(), policy.Revision)
+	a.policyBundleETag = etag
+	if a.shadowPolicyFile != "" {
+		if err := a.loadShadowPolicy(); err != nil {
+			logrus.WithError(err).WithField("shadowPolicy", a.shadowPolicyFile).Fatal("Error loading shadow policy")
+		}
 	}
 	return a
 }
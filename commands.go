@@ -0,0 +1,8 @@
+package main
+
+// commands are the subcommands that otre runs instead of the
+// proxy when named as the first argument
+var commands = map[string]func(args []string) int{
+	"replay": replayCommand,
+	"test":   testCommand,
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/summary"
+	"github.com/willthames/otre/traces"
+)
+
+// evaluateResponse is the response from the /debug/evaluate endpoint
+type evaluateResponse struct {
+	TraceIDs []string `json:"traceIds"`
+	Spans    int      `json:"spans"`
+	*rules.Explanation
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleEvaluate handles the /debug/evaluate POST endpoint. It evaluates
+// the posted spans against the live policy and responds with the result,
+// the rules satisfied and an explanation of the evaluation. The spans
+// are not added to the trace buffer or sent to any destination. The
+// format query parameter sets the span format as for otre replay, and
+// explain selects full, notes or fails explanations
+func (a *app) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zipkin-v2"
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	spans, err := decodeSpans(format, data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	explanation, err := a.re.Explain(spans, r.URL.Query().Get("explain"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	response := evaluateResponse{TraceIDs: []string{}, Spans: len(spans), Explanation: explanation}
+	seen := make(map[string]bool)
+	for _, span := range spans {
+		if !seen[span.TraceID] {
+			seen[span.TraceID] = true
+			response.TraceIDs = append(response.TraceIDs, span.TraceID)
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// traceSummary describes a trace in the trace buffer
+type traceSummary struct {
+	TraceID         string              `json:"traceId"`
+	Spans           int                 `json:"spans"`
+	AgeMs           int64               `json:"ageMs"`
+	Complete        bool                `json:"complete"`
+	MissingSpans    []traces.SpanID     `json:"missingSpans"`
+	RootService     string              `json:"rootService,omitempty"`
+	RootName        string              `json:"rootName,omitempty"`
+	PendingDecision string              `json:"pendingDecision"`
+	SampleResult    *rules.SampleResult `json:"sampleResult,omitempty"`
+}
+
+// traceDetail is a trace summary along with the trace's spans
+// and their tree
+type traceDetail struct {
+	traceSummary
+	SpanList []types.Span  `json:"spanList"`
+	Tree     *summary.Tree `json:"tree"`
+}
+
+// tracesResponse is the response from the /debug/traces endpoint
+type tracesResponse struct {
+	Total  int             `json:"total"`
+	Traces []*traceSummary `json:"traces"`
+}
+
+// pendingDecision describes what decideTrace will do with a trace the
+// next time the trace buffer is processed
+func (a *app) pendingDecision(trace *traces.Trace, complete bool, now time.Time) string {
+	_, result := trace.Sample()
+	switch {
+	case result != nil:
+		return "resend"
+	case complete && trace.OlderThanRelative(a.flushAge, now):
+		return "evaluate"
+	case complete:
+		return "wait for flushAge"
+	case trace.OlderThanRelative(a.abandonAge, now):
+		return "abandon"
+	}
+	return "wait for missing spans"
+}
+
+func (a *app) summarizeTrace(trace *traces.Trace, now time.Time) *traceSummary {
+	complete := trace.IsComplete()
+	summary := &traceSummary{
+		TraceID:         string(trace.ID()),
+		Spans:           trace.SpanCount(),
+		AgeMs:           int64(now.Sub(trace.LastFinished()) / time.Millisecond),
+		Complete:        complete,
+		MissingSpans:    trace.MissingSpans(),
+		PendingDecision: a.pendingDecision(trace, complete, now),
+	}
+	_, summary.SampleResult = trace.Sample()
+	if root, err := trace.RootSpan(); err == nil {
+		summary.RootService, summary.RootName = root.ServiceName, root.Name
+	}
+	return summary
+}
+
+// spanFilter matches spans by service name, span name and tag. Empty
+// fields match any span
+type spanFilter struct {
+	service string
+	name    string
+	tag     string
+}
+
+func (f spanFilter) empty() bool {
+	return f.service == "" && f.name == "" && f.tag == ""
+}
+
+func (f spanFilter) matchSpan(span types.Span) bool {
+	if f.service != "" && span.ServiceName != f.service {
+		return false
+	}
+	if f.name != "" && !strings.Contains(span.Name, f.name) {
+		return false
+	}
+	if f.tag != "" {
+		parts := strings.SplitN(f.tag, "=", 2)
+		value, ok := span.BinaryAnnotations[parts[0]]
+		if !ok || (len(parts) == 2 && fmt.Sprint(value) != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns whether any span in a trace matches the filter
+func (f spanFilter) match(trace *traces.Trace) bool {
+	if f.empty() {
+		return true
+	}
+	for _, span := range trace.CopySpans() {
+		if f.matchSpan(span) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTraces handles the /debug/traces GET endpoint, listing the
+// traces in the trace buffer, oldest first. The service, name and tag
+// query parameters list only traces with a span from that service, with
+// a name containing name, or with that tag, given as key or key=value.
+// limit sets the maximum number of traces listed, 100 by default
+func (a *app) handleTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := 100
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a non-negative integer"})
+			return
+		}
+	}
+	filter := spanFilter{service: query.Get("service"), name: query.Get("name"), tag: query.Get("tag")}
+	now := time.Now()
+	response := tracesResponse{Traces: []*traceSummary{}}
+	a.traceBuffer.RLock()
+	for _, trace := range a.traceBuffer.Traces {
+		if filter.match(trace) {
+			response.Traces = append(response.Traces, a.summarizeTrace(trace, now))
+		}
+	}
+	a.traceBuffer.RUnlock()
+	sort.Slice(response.Traces, func(i, j int) bool {
+		if response.Traces[i].AgeMs != response.Traces[j].AgeMs {
+			return response.Traces[i].AgeMs > response.Traces[j].AgeMs
+		}
+		return response.Traces[i].TraceID < response.Traces[j].TraceID
+	})
+	response.Total = len(response.Traces)
+	if len(response.Traces) > limit {
+		response.Traces = response.Traces[:limit]
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleTrace handles the /debug/traces/{traceId} GET endpoint,
+// responding with the summary and spans of a trace in the trace buffer
+func (a *app) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	traceID := strings.TrimPrefix(r.URL.Path, "/debug/traces/")
+	trace, ok := a.traceBuffer.Get(traces.TraceID(traceID))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "trace " + traceID + " is not in the trace buffer"})
+		return
+	}
+	spans := trace.CopySpans()
+	writeJSON(w, http.StatusOK, traceDetail{traceSummary: *a.summarizeTrace(trace, time.Now()), SpanList: spans, Tree: summary.NewTree(spans)})
+}
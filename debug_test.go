@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/willthames/otre/rules"
+)
+
+func TestHandleEvaluate(t *testing.T) {
+	a, destination := newTestApp(t, 25)
+	body := `[{"traceId": "000000000000000c", "id": "000000000000000c", "name": "/ping", "localEndpoint": {"serviceName": "web"}}]`
+	w := httptest.NewRecorder()
+	a.handleEvaluate(w, httptest.NewRequest("POST", "/debug/evaluate?explain=full", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 evaluating a trace, got %d: %s", w.Code, w.Body.String())
+	}
+	var response evaluateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Result == nil || response.Result.SampleRate != 25 || response.Result.Reason != "test policy" {
+		t.Errorf("Response should include the sample result, got %+v", response.Result)
+	}
+	if len(response.SatisfiedRules) == 0 || !strings.HasPrefix(response.SatisfiedRules[0], "data.otre.response") {
+		t.Errorf("Response should include the satisfied rules, got %v", response.SatisfiedRules)
+	}
+	if len(response.Explain) == 0 || len(response.TraceIDs) != 1 {
+		t.Errorf("Response should include an explanation and the trace ID")
+	}
+	if a.traceBuffer.Len() != 0 || len(destination.payloads) != 0 {
+		t.Errorf("Evaluated trace should not be buffered or sent")
+	}
+
+	for query, status := range map[string]int{"explain=everything": http.StatusBadRequest, "format=jaeger": http.StatusBadRequest} {
+		w = httptest.NewRecorder()
+		a.handleEvaluate(w, httptest.NewRequest("POST", "/debug/evaluate?"+query, strings.NewReader(body)))
+		if w.Code != status {
+			t.Errorf("Expected %d for %s, got %d", status, query, w.Code)
+		}
+	}
+}
+
+func TestHandleTraces(t *testing.T) {
+	a, _ := newTestApp(t, 100)
+	now := time.Now()
+	addTestTrace(a, "old", now.Add(-2*time.Minute), true)
+	addTestTrace(a, "recent", now, true)
+	addTestTrace(a, "incomplete", now.Add(-2*time.Minute), false)
+	addTestTrace(a, "abandoned", now.Add(-6*time.Minute), false)
+	a.traceBuffer.AddSpan(types.Span{
+		CoreSpanMetadata:  types.CoreSpanMetadata{TraceID: "recent", ID: "recent-child", ParentID: "recent-root", Name: "/orders", ServiceName: "orders"},
+		Timestamp:         now,
+		BinaryAnnotations: map[string]interface{}{"http.status_code": 500},
+	})
+
+	w := httptest.NewRecorder()
+	a.handleTraces(w, httptest.NewRequest("GET", "/debug/traces", nil))
+	var response tracesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Total != 4 || len(response.Traces) != 4 || response.Traces[0].TraceID != "abandoned" {
+		t.Fatalf("Expected all traces, oldest first, got %+v", response)
+	}
+	expected := map[string]string{
+		"old":        "evaluate",
+		"recent":     "wait for flushAge",
+		"incomplete": "wait for missing spans",
+		"abandoned":  "abandon",
+	}
+	for _, summary := range response.Traces {
+		if summary.PendingDecision != expected[summary.TraceID] {
+			t.Errorf("Expected %s to %s, got %s", summary.TraceID, expected[summary.TraceID], summary.PendingDecision)
+		}
+	}
+	if response.Traces[0].Complete || len(response.Traces[0].MissingSpans) != 1 || response.Traces[0].AgeMs < 6*60*1000 {
+		t.Errorf("Expected abandoned trace to be incomplete and six minutes old, got %+v", response.Traces[0])
+	}
+
+	for query, traceID := range map[string]string{
+		"service=orders":           "recent",
+		"name=order":               "recent",
+		"tag=http.status_code":     "recent",
+		"tag=http.status_code=500": "recent",
+		"limit=1":                  "abandoned",
+	} {
+		w = httptest.NewRecorder()
+		a.handleTraces(w, httptest.NewRequest("GET", "/debug/traces?"+query, nil))
+		response = tracesResponse{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if len(response.Traces) != 1 || response.Traces[0].TraceID != traceID {
+			t.Errorf("Expected only %s for %s, got %+v", traceID, query, response.Traces)
+		}
+	}
+	w = httptest.NewRecorder()
+	a.handleTraces(w, httptest.NewRequest("GET", "/debug/traces?tag=http.status_code=200", nil))
+	response = tracesResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Total != 0 || response.Traces == nil {
+		t.Errorf("Expected an empty list of traces, got %+v", response)
+	}
+
+	w = httptest.NewRecorder()
+	a.handleTrace(w, httptest.NewRequest("GET", "/debug/traces/recent", nil))
+	var detail traceDetail
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || detail.Spans != 2 || len(detail.SpanList) != 2 || !detail.Complete || len(detail.Tree.Roots) != 1 {
+		t.Errorf("Expected the spans of the recent trace, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	a.handleTrace(w, httptest.NewRequest("GET", "/debug/traces/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a trace not in the buffer, got %d", w.Code)
+	}
+}
+
+// TestHandleTraceWhileDeciding checks that inspecting a trace is safe
+// while it is being decided on, when run with -race
+func TestHandleTraceWhileDeciding(t *testing.T) {
+	a, _ := newTestApp(t, 100)
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			a.handleTrace(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/traces/old", nil))
+			a.handleTraces(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/traces?tag=SampleReason", nil))
+		}
+	}()
+	trace, _ := a.traceBuffer.Get("old")
+	for i := 0; i < 100; i++ {
+		a.acceptTrace(trace, &rules.SampleResult{SampleRate: 100, Reason: "test"}, acceptedTraces)
+	}
+	<-done
+}
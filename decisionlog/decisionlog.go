@@ -0,0 +1,242 @@
+package decisionlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	decisionsLogged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_decision_log_entries_total",
+		Help: "The total number of decisions written to the decision log",
+	})
+	decisionsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_decision_log_dropped_total",
+		Help: "The total number of decisions not written to the decision log by reason",
+	}, []string{"reason"})
+)
+
+// ShadowDecision is the decision the shadow policy would have made
+type ShadowDecision struct {
+	Decision   bool   `json:"decision"`
+	Reason     string `json:"reason"`
+	SampleRate int    `json:"sampleRate"`
+}
+
+// Decision is a decision log entry for an evaluated trace
+type Decision struct {
+	Time          time.Time       `json:"time"`
+	TraceID       string          `json:"traceId"`
+	RootService   string          `json:"rootService,omitempty"`
+	RootName      string          `json:"rootName,omitempty"`
+	Spans         int             `json:"spans"`
+	DurationMs    float64         `json:"durationMs"`
+	Reason        string          `json:"reason"`
+	SampleRate    int             `json:"sampleRate"`
+	Decision      bool            `json:"decision"`
+	Revision      string          `json:"revision,omitempty"`
+	EvalLatencyMs float64         `json:"evalLatencyMs"`
+	Shadow        *ShadowDecision `json:"shadow,omitempty"`
+}
+
+// Sink is a destination for batches of decisions
+type Sink interface {
+	Write(decisions []*Decision) error
+	Close() error
+}
+
+// writerSink writes decisions as JSON lines
+type writerSink struct {
+	w io.WriteCloser
+}
+
+func (s *writerSink) Write(decisions []*Decision) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, decision := range decisions {
+		if err := encoder.Encode(decision); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.w == os.Stdout {
+		return nil
+	}
+	return s.w.Close()
+}
+
+// httpSink POSTs each batch of decisions as a JSON array
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Write(decisions []*Decision) error {
+	body, err := json.Marshal(decisions)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("decision log server returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// NewSink creates a sink from a destination: stdout, an http or
+// https URL, or otherwise the path of a JSONL file to append to
+func NewSink(destination string) (Sink, error) {
+	switch {
+	case destination == "stdout":
+		return &writerSink{w: os.Stdout}, nil
+	case strings.HasPrefix(destination, "http://"), strings.HasPrefix(destination, "https://"):
+		return &httpSink{url: destination, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	f, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f}, nil
+}
+
+// Logger queues decisions and writes them to a Sink in batches of up to
+// BatchSize, or every FlushInterval. Only a Sample proportion of decisions
+// passed to Log are kept, and decisions are dropped if the queue of
+// BufSize decisions is full
+type Logger struct {
+	Sink          Sink
+	Sample        float64
+	BatchSize     int
+	FlushInterval time.Duration
+	BufSize       int
+
+	decisions chan *Decision
+	done      chan struct{}
+	// lock guards stopped and queueing decisions, so that decisions
+	// logged during or after Stop are dropped rather than sent on the
+	// closed queue
+	lock    sync.Mutex
+	stopped bool
+}
+
+// NewLogger creates a Logger writing to sink
+func NewLogger(sink Sink, sample float64) *Logger {
+	l := new(Logger)
+	l.Sink = sink
+	l.Sample = sample
+	return l
+}
+
+// Start starts writing queued decisions to the sink
+func (l *Logger) Start() error {
+	if l.BatchSize <= 0 {
+		l.BatchSize = 100
+	}
+	if l.FlushInterval <= 0 {
+		l.FlushInterval = time.Second
+	}
+	if l.BufSize <= 0 {
+		l.BufSize = 10000
+	}
+	l.decisions = make(chan *Decision, l.BufSize)
+	l.done = make(chan struct{})
+	go l.run()
+	return nil
+}
+
+// Stop writes any queued decisions and closes the sink. Decisions
+// logged after Stop are dropped
+func (l *Logger) Stop() error {
+	l.lock.Lock()
+	if !l.stopped {
+		l.stopped = true
+		close(l.decisions)
+	}
+	l.lock.Unlock()
+	<-l.done
+	return l.Sink.Close()
+}
+
+func (l *Logger) flush(batch []*Decision) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := l.Sink.Write(batch); err != nil {
+		logrus.WithError(err).Warn("Error writing decision log")
+		decisionsDropped.WithLabelValues("error").Add(float64(len(batch)))
+		return
+	}
+	decisionsLogged.Add(float64(len(batch)))
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Decision, 0, l.BatchSize)
+	for {
+		select {
+		case decision, ok := <-l.decisions:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, decision)
+			if len(batch) >= l.BatchSize {
+				l.flush(batch)
+				batch = make([]*Decision, 0, l.BatchSize)
+			}
+		case <-ticker.C:
+			l.flush(batch)
+			batch = make([]*Decision, 0, l.BatchSize)
+		}
+	}
+}
+
+// Log queues a decision to be written, subject to sampling
+func (l *Logger) Log(decision *Decision) {
+	if l.Sample < 1 && rand.Float64() >= l.Sample {
+		decisionsDropped.WithLabelValues("sampled").Inc()
+		return
+	}
+	l.LogAlways(decision)
+}
+
+// LogAlways queues a decision to be written regardless of sampling
+func (l *Logger) LogAlways(decision *Decision) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopped {
+		decisionsDropped.WithLabelValues("stopped").Inc()
+		return
+	}
+	select {
+	case l.decisions <- decision:
+	default:
+		decisionsDropped.WithLabelValues("full").Inc()
+	}
+}
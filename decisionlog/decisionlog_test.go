@@ -0,0 +1,78 @@
+package decisionlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "decisions.jsonl")
+	sink, err := NewSink(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(sink, 0)
+	l.Start()
+	l.Log(&Decision{TraceID: "sampled out"})
+	l.LogAlways(&Decision{TraceID: "a", Reason: "test", SampleRate: 25, Shadow: &ShadowDecision{Decision: true}})
+	l.Stop()
+	// decisions made while shutting down are dropped
+	l.LogAlways(&Decision{TraceID: "after stop"})
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var decisions []Decision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatalf("Decision log line should be JSON: %v", err)
+		}
+		decisions = append(decisions, d)
+	}
+	if len(decisions) != 1 || decisions[0].TraceID != "a" || decisions[0].Shadow == nil {
+		t.Errorf("Expected only the unsampled decision to be logged, got %+v", decisions)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var received []*Decision
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*Decision
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, batch...)
+	}))
+	defer server.Close()
+
+	sink, err := NewSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(sink, 1)
+	l.BatchSize = 2
+	l.Start()
+	for _, id := range []string{"a", "b", "c"} {
+		l.Log(&Decision{TraceID: id})
+	}
+	l.Stop()
+	if len(received) != 3 {
+		t.Errorf("Expected 3 decisions posted to the decision log server, got %d", len(received))
+	}
+}
@@ -0,0 +1,115 @@
+package decisionlog
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tailSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otre_decision_tail_subscribers",
+		Help: "The number of clients tailing decisions",
+	})
+	tailDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_decision_tail_dropped_total",
+		Help: "The total number of decisions not sent to a tailing client because its buffer was full",
+	})
+)
+
+// Filter selects the decisions sent to a subscriber. Service must equal
+// the root service and Reason must be part of the reason, while an empty
+// Service or Reason and a nil Decision match any decision
+type Filter struct {
+	Service  string
+	Reason   string
+	Decision *bool
+}
+
+// Match returns whether a decision passes the filter
+func (f Filter) Match(d *Decision) bool {
+	if f.Service != "" && d.RootService != f.Service {
+		return false
+	}
+	if f.Reason != "" && !strings.Contains(d.Reason, f.Reason) {
+		return false
+	}
+	return f.Decision == nil || *f.Decision == d.Decision
+}
+
+// Subscription receives the decisions matching its filter on C
+type Subscription struct {
+	C       <-chan *Decision
+	c       chan *Decision
+	filter  Filter
+	dropped uint64
+}
+
+// Dropped returns the number of decisions dropped because the
+// subscription's buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Tail broadcasts decisions to subscribers as they are made. Each
+// subscriber has its own bounded buffer, and decisions are dropped
+// rather than waiting for a slow subscriber
+type Tail struct {
+	subscribers map[*Subscription]bool
+	sync.RWMutex
+}
+
+// NewTail creates a Tail with no subscribers
+func NewTail() *Tail {
+	return &Tail{subscribers: make(map[*Subscription]bool)}
+}
+
+// Subscribe returns a subscription to decisions matching filter,
+// buffering up to bufSize decisions
+func (t *Tail) Subscribe(filter Filter, bufSize int) *Subscription {
+	c := make(chan *Decision, bufSize)
+	s := &Subscription{C: c, c: c, filter: filter}
+	t.Lock()
+	t.subscribers[s] = true
+	t.Unlock()
+	tailSubscribers.Inc()
+	return s
+}
+
+// Unsubscribe stops sending decisions to a subscription
+func (t *Tail) Unsubscribe(s *Subscription) {
+	t.Lock()
+	defer t.Unlock()
+	if t.subscribers[s] {
+		delete(t.subscribers, s)
+		tailSubscribers.Dec()
+	}
+}
+
+// Subscribers returns the number of subscribers
+func (t *Tail) Subscribers() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.subscribers)
+}
+
+// Publish sends a decision to every subscriber whose filter it matches
+// and whose buffer has room. It never blocks
+func (t *Tail) Publish(d *Decision) {
+	t.RLock()
+	defer t.RUnlock()
+	for s := range t.subscribers {
+		if !s.filter.Match(d) {
+			continue
+		}
+		select {
+		case s.c <- d:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			tailDropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package decisionlog
+
+import "testing"
+
+func TestTail(t *testing.T) {
+	tail := NewTail()
+	rejected := false
+	all := tail.Subscribe(Filter{}, 2)
+	filtered := tail.Subscribe(Filter{Service: "web", Reason: "errors", Decision: &rejected}, 10)
+
+	tail.Publish(&Decision{TraceID: "1", RootService: "web", Reason: "errors sampled", Decision: false})
+	tail.Publish(&Decision{TraceID: "2", RootService: "web", Reason: "errors sampled", Decision: true})
+	tail.Publish(&Decision{TraceID: "3", RootService: "api", Reason: "errors sampled", Decision: false})
+
+	if len(all.C) != 2 || all.Dropped() != 1 {
+		t.Errorf("Expected a full buffer and one dropped decision, got %d buffered and %d dropped", len(all.C), all.Dropped())
+	}
+	if len(filtered.C) != 1 || (<-filtered.C).TraceID != "1" || filtered.Dropped() != 0 {
+		t.Errorf("Expected only the matching decision for the filtered subscription")
+	}
+
+	tail.Unsubscribe(all)
+	tail.Unsubscribe(all)
+	if tail.Subscribers() != 1 {
+		t.Errorf("Expected one subscriber left, got %d", tail.Subscribers())
+	}
+}
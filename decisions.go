@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/willthames/otre/decisionlog"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+var (
+	decisionTraces = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_decision_traces_total",
+		Help: "The total number of traces sampled by reason, root service and decision",
+	}, []string{"reason", "service", "decision"})
+	decisionSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_decision_spans_total",
+		Help: "The total number of spans in traces sampled by reason, root service and decision",
+	}, []string{"reason", "service", "decision"})
+)
+
+// otherLabel replaces label values beyond a labelLimiter's limit
+const otherLabel = "other"
+
+// labelLimiter caps the number of distinct values of a metric label.
+// Values seen after the limit is reached are reported as otherLabel
+type labelLimiter struct {
+	max    int
+	values map[string]bool
+	sync.Mutex
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, values: make(map[string]bool)}
+}
+
+func (l *labelLimiter) value(v string) string {
+	l.Lock()
+	defer l.Unlock()
+	if l.values[v] {
+		return v
+	}
+	if len(l.values) >= l.max {
+		return otherLabel
+	}
+	l.values[v] = true
+	return v
+}
+
+// recordDecision counts a sampling decision and the spans it covers
+func (a *app) recordDecision(trace *traces.Trace, decision bool, reason string) {
+	service := "unknown"
+	if root, err := trace.RootSpan(); err == nil && root.ServiceName != "" {
+		service = root.ServiceName
+	}
+	decisionLabel := "rejected"
+	if decision {
+		decisionLabel = "accepted"
+	}
+	labels := []string{a.reasonLabels.value(reason), a.serviceLabels.value(service), decisionLabel}
+	decisionTraces.WithLabelValues(labels...).Inc()
+	decisionSpans.WithLabelValues(labels...).Add(float64(trace.SpanCount()))
+}
+
+// newDecision creates a decision log entry for a trace
+func newDecision(trace *traces.Trace, spans []types.Span, decision bool, result *rules.SampleResult, latency time.Duration) *decisionlog.Decision {
+	d := &decisionlog.Decision{
+		Time:          time.Now(),
+		TraceID:       string(trace.ID()),
+		Spans:         len(spans),
+		Reason:        result.Reason,
+		SampleRate:    result.SampleRate,
+		Decision:      decision,
+		Revision:      result.Revision,
+		EvalLatencyMs: latency.Seconds() * 1000,
+	}
+	if d.Revision == "" {
+		d.Revision = result.PolicyHash
+	}
+	if root, err := trace.RootSpan(); err == nil {
+		d.RootService, d.RootName, d.DurationMs = root.ServiceName, root.Name, root.DurationMs
+		return d
+	}
+	// without a root span, the longest span is the best estimate of duration
+	for _, span := range spans {
+		if span.DurationMs > d.DurationMs {
+			d.DurationMs = span.DurationMs
+		}
+	}
+	return d
+}
+
+// logOverride writes a decision made without evaluating the policy,
+// such as accepting an abandoned trace, to the decision log
+func (a *app) logOverride(trace *traces.Trace, decision bool, result *rules.SampleResult) {
+	a.logDecision(trace, trace.Spans(), decision, result, 0, nil)
+}
+
+// logDecision writes the decision for a trace to the decision
+// log, if there is one, and to any clients tailing decisions. Sampled
+// disagreements with the shadow policy are logged regardless of the
+// decision log's own sampling
+func (a *app) logDecision(trace *traces.Trace, spans []types.Span, decision bool, result *rules.SampleResult, latency time.Duration, shadow *decisionlog.ShadowDecision) {
+	tailing := a.tail != nil && a.tail.Subscribers() > 0
+	if a.decisionLog == nil && shadow != nil {
+		logrus.WithField("traceID", trace.ID()).
+			WithField("decision", decision).
+			WithField("reason", result.Reason).
+			WithField("shadowDecision", shadow.Decision).
+			WithField("shadowReason", shadow.Reason).
+			Info("Shadow policy disagrees with active policy")
+	}
+	if a.decisionLog == nil && !tailing {
+		return
+	}
+	d := newDecision(trace, spans, decision, result, latency)
+	d.Shadow = shadow
+	if tailing {
+		a.tail.Publish(d)
+	}
+	switch {
+	case a.decisionLog == nil:
+	case shadow != nil:
+		a.decisionLog.LogAlways(d)
+	default:
+		a.decisionLog.Log(d)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/willthames/otre/decisionlog"
+)
+
+// recordingSink keeps every decision written to it
+type recordingSink struct {
+	decisions []*decisionlog.Decision
+}
+
+func (s *recordingSink) Write(decisions []*decisionlog.Decision) error {
+	s.decisions = append(s.decisions, decisions...)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestDecisionLog(t *testing.T) {
+	a, _ := newTestApp(t, 100)
+	sink := new(recordingSink)
+	a.decisionLog = decisionlog.NewLogger(sink, 1)
+	a.decisionLog.Start()
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	a.decisionLog.Stop()
+
+	if len(sink.decisions) != 1 {
+		t.Fatalf("Expected 1 decision logged, got %d", len(sink.decisions))
+	}
+	d := sink.decisions[0]
+	if d.TraceID != "old" || !d.Decision || d.Reason != "test policy" || d.SampleRate != 100 || d.Spans != 1 {
+		t.Errorf("Decision log entry doesn't match the decision: %+v", d)
+	}
+	if d.Revision == "" || d.Revision != a.re.Evaluate(nil).PolicyHash {
+		t.Errorf("Decision from a policy without a revision should be logged with the policy hash, got %q", d.Revision)
+	}
+}
+
+func TestDecisionLogOverrides(t *testing.T) {
+	a, _ := newTestApp(t, 100)
+	a.shutdownIncomplete = "reject"
+	sink := new(recordingSink)
+	a.decisionLog = decisionlog.NewLogger(sink, 1)
+	a.decisionLog.Start()
+	now := time.Now()
+	addTestTrace(a, "abandoned", now.Add(-6*time.Minute), false)
+	a.processSpans()
+	addTestTrace(a, "dropped", now, true)
+	a.processTrace("dropped", a.dropTrace)
+	addTestTrace(a, "incomplete", now, false)
+	a.flushTraces()
+	a.decisionLog.Stop()
+
+	expected := map[string]bool{"abandoned": true, "dropped": false, "incomplete": false}
+	if len(sink.decisions) != len(expected) {
+		t.Fatalf("Expected %d decisions logged, got %d", len(expected), len(sink.decisions))
+	}
+	for _, d := range sink.decisions {
+		if decision, ok := expected[d.TraceID]; !ok || d.Decision != decision || d.Reason == "" || d.Revision != "" {
+			t.Errorf("Decision made without the policy doesn't match for %s: %+v", d.TraceID, d)
+		}
+	}
+}
+
+func TestDecisionMetrics(t *testing.T) {
+	a, _ := newTestApp(t, 0)
+	a.reasonLabels = newLabelLimiter(1)
+	rejected := testutil.ToFloat64(decisionTraces.WithLabelValues("test policy", "unknown", "rejected"))
+	rejectedSpans := testutil.ToFloat64(decisionSpans.WithLabelValues("test policy", "unknown", "rejected"))
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	if testutil.ToFloat64(decisionTraces.WithLabelValues("test policy", "unknown", "rejected")) != rejected+1 {
+		t.Errorf("Rejected trace should be counted by reason, service and decision")
+	}
+	if testutil.ToFloat64(decisionSpans.WithLabelValues("test policy", "unknown", "rejected")) != rejectedSpans+1 {
+		t.Errorf("Spans in rejected trace should be counted by reason, service and decision")
+	}
+
+	if a.reasonLabels.value("test policy") != "test policy" || a.reasonLabels.value("another reason") != otherLabel {
+		t.Errorf("Label values beyond the limit should be reported as %s", otherLabel)
+	}
+}
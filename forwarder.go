@@ -11,35 +11,122 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type payload struct {
-	ContentType string
-	Body        []byte
+	ContentType     string
+	ContentEncoding string
+	Path            string
+	Body            []byte
+	TraceID         string
+	SampleRate      int
+	Spans           []types.Span
+}
+
+// Destination is somewhere that accepted traces are sent
+type Destination interface {
+	Start() error
+	Stop() error
+	Send(p payload) error
+	Circuit() *CircuitBreaker
+}
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 10 * time.Second
+)
+
+var (
+	destinationQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otre_destination_queue_length",
+		Help: "The number of payloads waiting to be sent to a destination",
+	}, []string{"destination"})
+	destinationQueueCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otre_destination_queue_capacity",
+		Help: "The maximum number of payloads that can wait to be sent to a destination",
+	}, []string{"destination"})
+	destinationInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otre_destination_requests_in_flight",
+		Help: "The number of requests to a destination awaiting a response",
+	}, []string{"destination"})
+	destinationLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otre_destination_request_duration_seconds",
+		Help:    "The time taken for a destination to respond to a request",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"destination"})
+	destinationResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_destination_responses_total",
+		Help: "The total number of responses from a destination by status code",
+	}, []string{"destination", "code"})
+	destinationBytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_destination_sent_bytes_total",
+		Help: "The total number of payload bytes sent to a destination",
+	}, []string{"destination"})
+	destinationDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_destination_dropped_total",
+		Help: "The total number of payloads dropped before being sent to a destination",
+	}, []string{"destination", "reason"})
+	destinationRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_destination_retries_total",
+		Help: "The total number of requests resent to a destination after an error",
+	}, []string{"destination"})
+)
+
+var (
+	errSinkStopped = errors.New("sink stopped")
+	errSinkFull    = errors.New("sink full")
+	// errTraceTooLarge is returned for a trace that can never fit in a
+	// destination's queue, so sending it again is pointless
+	errTraceTooLarge = errors.New("trace too large")
+)
+
+// dropped records the reason a payload could not be queued for a destination
+func dropped(destination string, err error) error {
+	destinationDropped.WithLabelValues(destination, err.Error()).Inc()
+	return err
 }
 
 // Forwarder sends traffic to a DownstreamURL
 type Forwarder struct {
+	Name           string
 	DownstreamURL  *url.URL
 	BufSize        int
 	MaxConcurrency int
+	// PreservePath sends each payload to its own Path on the
+	// downstream host rather than to the DownstreamURL path
+	PreservePath bool
+	Breaker      *CircuitBreaker
 
+	client   *http.Client
 	payloads chan payload
 	stopped  bool
 	wg       sync.WaitGroup
 }
 
 func (f *Forwarder) Start() error {
+	if f.Name == "" {
+		f.Name = "collector"
+	}
 	if f.MaxConcurrency == 0 {
 		f.MaxConcurrency = 100
 	}
 	if f.BufSize == 0 {
 		f.BufSize = 4096
 	}
+	if f.Breaker == nil {
+		f.Breaker = NewCircuitBreaker(f.Name, defaultFailureThreshold, defaultOpenTimeout)
+	}
+	f.client = &http.Client{}
 	f.payloads = make(chan payload, f.BufSize)
+	destinationQueueCapacity.WithLabelValues(f.Name).Set(float64(f.BufSize))
 	for i := 0; i < f.MaxConcurrency; i++ {
 		f.wg.Add(1)
 		go f.runWorker()
@@ -57,54 +144,117 @@ func (f *Forwarder) Stop() error {
 	return nil
 }
 
+// failed returns whether a request failed in a way that counts
+// against the downstream host's circuit breaker
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// send makes a single request to the downstream host, recording
+// its outcome
+func (f *Forwarder) send(p payload) (*http.Response, error) {
+	downstreamURL := *f.DownstreamURL
+	if f.PreservePath && p.Path != "" {
+		downstreamURL.Path = p.Path
+	}
+	r, err := http.NewRequest("POST", downstreamURL.String(), bytes.NewReader(p.Body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", p.ContentType)
+	if p.ContentEncoding != "" {
+		r.Header.Set("Content-Encoding", p.ContentEncoding)
+	}
+	inFlight := destinationInFlight.WithLabelValues(f.Name)
+	inFlight.Inc()
+	start := time.Now()
+	resp, err := f.client.Do(r)
+	destinationLatency.WithLabelValues(f.Name).Observe(time.Since(start).Seconds())
+	inFlight.Dec()
+	if err != nil {
+		destinationResponses.WithLabelValues(f.Name, "error").Inc()
+		return nil, err
+	}
+	destinationResponses.WithLabelValues(f.Name, strconv.Itoa(resp.StatusCode)).Inc()
+	destinationBytesSent.WithLabelValues(f.Name).Add(float64(len(p.Body)))
+	return resp, nil
+}
+
+// Circuit returns the circuit breaker guarding the downstream host
+func (f *Forwarder) Circuit() *CircuitBreaker {
+	return f.Breaker
+}
+
 func (f *Forwarder) runWorker() {
 	for p := range f.payloads {
-		r, err := http.NewRequest("POST", f.DownstreamURL.String(), bytes.NewReader(p.Body))
-		r.Header.Set("Content-Type", p.ContentType)
-		if err != nil {
-			logrus.WithError(err).Info("Error building downstream request")
-			return
+		destinationQueueLength.WithLabelValues(f.Name).Set(float64(len(f.payloads)))
+		// payloads are only refused by Send, as a queued payload has
+		// already been reported as sent and removed from the buffer
+		resp, err := f.send(p)
+		if failed(resp, err) {
+			f.Breaker.Failure()
+		} else {
+			f.Breaker.Success()
 		}
-		client := &http.Client{}
-		resp, err := client.Do(r)
 		if err != nil {
-			logrus.WithError(err).Info("Error sending payload downstream")
+			logrus.WithError(err).WithField("destination", f.Name).Info("Error sending payload downstream")
 			continue
 		}
-		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusAccepted {
 			responseBody, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
 			logrus.WithField("status", resp.Status).
+				WithField("destination", f.Name).
 				WithField("response", string(responseBody)).
 				Info("Error response sending payload downstream")
 			logrus.WithField("payload", string(p.Body)).Debug("Error response sending payload downstream")
 		}
+		resp.Body.Close()
 	}
 	f.wg.Done()
 }
 
+// QueueLength returns the number of payloads waiting to be sent
+func (f *Forwarder) QueueLength() int {
+	return len(f.payloads)
+}
+
 func (f *Forwarder) Send(p payload) error {
 	if f.stopped {
-		return errors.New("sink stopped")
+		return dropped(f.Name, errSinkStopped)
+	}
+	if !f.Breaker.Allow() {
+		return dropped(f.Name, errCircuitOpen)
 	}
 	select {
 	case f.payloads <- p:
+		destinationQueueLength.WithLabelValues(f.Name).Set(float64(len(f.payloads)))
 		return nil
 	default:
-		return errors.New("sink full")
+		return dropped(f.Name, errSinkFull)
 	}
 }
 
-func NewForwarder(collector string) (*Forwarder, error) {
-	downstreamURL, err := url.Parse(collector)
+func parseDownstreamURL(downstream string) (*url.URL, error) {
+	downstreamURL, err := url.Parse(downstream)
 	if err != nil {
-		return nil, fmt.Errorf("invalid downstream url %s", collector)
+		return nil, fmt.Errorf("invalid downstream url %s", downstream)
 	}
 
 	scheme := downstreamURL.Scheme
 	isHTTP := scheme == "http" || scheme == "https"
 	if !isHTTP {
-		return nil, fmt.Errorf("invalid downstream url %s. Must be prefixed with http:// or https://", collector)
+		return nil, fmt.Errorf("invalid downstream url %s. Must be prefixed with http:// or https://", downstream)
+	}
+	return downstreamURL, nil
+}
+
+func NewForwarder(collector string) (*Forwarder, error) {
+	downstreamURL, err := parseDownstreamURL(collector)
+	if err != nil {
+		return nil, err
 	}
 
 	downstreamURL.Path = "/api/v1/spans"
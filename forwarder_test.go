@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestForwarderMetrics(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewForwarder(server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't create forwarder: %v", err)
+	}
+	forwarder.Name = "test-metrics"
+	forwarder.MaxConcurrency = 1
+	forwarder.Start()
+	for i := 0; i < 2; i++ {
+		if err := forwarder.Send(payload{ContentType: "application/json", Body: []byte("[]")}); err != nil {
+			t.Errorf("Couldn't send payload: %v", err)
+		}
+	}
+	forwarder.Stop()
+
+	if requests != 2 {
+		t.Errorf("Forwarder should send each payload once, made %d requests", requests)
+	}
+	for _, metric := range []struct {
+		name     string
+		value    float64
+		expected float64
+	}{
+		{"503 responses", testutil.ToFloat64(destinationResponses.WithLabelValues("test-metrics", "503")), 1},
+		{"202 responses", testutil.ToFloat64(destinationResponses.WithLabelValues("test-metrics", "202")), 1},
+		{"bytes sent", testutil.ToFloat64(destinationBytesSent.WithLabelValues("test-metrics")), 4},
+		{"in flight", testutil.ToFloat64(destinationInFlight.WithLabelValues("test-metrics")), 0},
+	} {
+		if metric.value != metric.expected {
+			t.Errorf("Expected %v for %s metric, got %v", metric.expected, metric.name, metric.value)
+		}
+	}
+	if err := forwarder.Send(payload{}); err != errSinkStopped {
+		t.Errorf("Sending to a stopped forwarder should return %v, not %v", errSinkStopped, err)
+	}
+	if dropped := testutil.ToFloat64(destinationDropped.WithLabelValues("test-metrics", "sink stopped")); dropped != 1 {
+		t.Errorf("Sending to a stopped forwarder should be counted as dropped, got %v", dropped)
+	}
+}
+
+func TestForwarderSendsQueuedPayloadsWhenCircuitOpens(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		first := requests == 1
+		lock.Unlock()
+		if first {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	forwarder, err := NewForwarder(server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't create forwarder: %v", err)
+	}
+	forwarder.Name = "test-queued"
+	forwarder.MaxConcurrency = 1
+	forwarder.Breaker = NewCircuitBreaker(forwarder.Name, 1, time.Minute)
+	forwarder.Start()
+	for i := 0; i < 2; i++ {
+		if err := forwarder.Send(payload{ContentType: "application/json", Body: []byte("[]")}); err != nil {
+			t.Errorf("Couldn't send payload: %v", err)
+		}
+	}
+	close(release)
+	forwarder.Stop()
+
+	if requests != 2 {
+		t.Errorf("A payload queued before the circuit opened should still be sent, made %d requests", requests)
+	}
+	if dropped := testutil.ToFloat64(destinationDropped.WithLabelValues("test-queued", errCircuitOpen.Error())); dropped != 0 {
+		t.Errorf("A queued payload should not be dropped when the circuit opens, got %v", dropped)
+	}
+}
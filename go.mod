@@ -3,6 +3,7 @@ module github.com/willthames/otre
 require github.com/open-policy-agent/opa v0.15.0
 
 require (
+	github.com/Shopify/sarama v1.23.1
 	github.com/Sirupsen/logrus v1.0.3
 	github.com/apache/thrift v0.0.0-20161221203622-b2a4d4ae21c7 // indirect
 	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a // indirect
@@ -12,9 +13,9 @@ require (
 	github.com/facebookgo/startstop v0.0.0-20161013234910-bc158412526d // indirect
 	github.com/facebookgo/structtag v0.0.0-20150214074306-217e25fb9691 // indirect
 	github.com/honeycombio/honeycomb-opentracing-proxy v2.1.0+incompatible
-	github.com/honeycombio/libhoney-go v1.12.2 // indirect
+	github.com/honeycombio/libhoney-go v1.12.2
 	github.com/jessevdk/go-flags v1.4.0 // indirect
-	github.com/klauspost/compress v1.9.1 // indirect
+	github.com/klauspost/compress v1.9.1
 	github.com/opentracing/opentracing-go v1.1.0 // indirect
 	github.com/prometheus/client_golang v0.0.0-20181025174421-f30f42803563
 	github.com/sirupsen/logrus v1.4.1
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	honeycombEventsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_honeycomb_events_sent_total",
+		Help: "The total number of events accepted by the honeycomb API",
+	})
+	honeycombSendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_honeycomb_send_errors_total",
+		Help: "The total number of events that could not be sent to honeycomb after all retries",
+	})
+)
+
+const (
+	// honeycombQueueOverflow is the error libhoney responds with for an
+	// event it dropped because its queue was full
+	honeycombQueueOverflow = "queue overflow"
+	// defaultHoneycombRetryBackoff is the delay before the first retry
+	// of a failed event, doubling with each further attempt
+	defaultHoneycombRetryBackoff = 100 * time.Millisecond
+)
+
+// honeycombEvent is kept as the metadata of each libhoney event
+// so that failed events can be rebuilt and resent
+type honeycombEvent struct {
+	span       types.Span
+	sampleRate uint
+	attempt    int
+}
+
+// honeycombMetrics records libhoney's transmission metrics
+// against a destination
+type honeycombMetrics struct {
+	destination string
+}
+
+func (m *honeycombMetrics) Gauge(name string, value interface{}) {
+	if length, ok := value.(int); ok && name == "queue_length" {
+		destinationQueueLength.WithLabelValues(m.destination).Set(float64(length))
+	}
+}
+
+func (m *honeycombMetrics) Increment(name string) {
+	if name == "queue_overflow" {
+		destinationDropped.WithLabelValues(m.destination, errSinkFull.Error()).Inc()
+	}
+}
+
+func (m *honeycombMetrics) Count(name string, value interface{}) {}
+
+// HoneycombForwarder sends the spans of accepted traces to the
+// honeycomb events API, one event per span
+type HoneycombForwarder struct {
+	Name         string
+	APIHost      string
+	Dataset      string
+	WriteKey     string
+	BatchSize    uint
+	BatchTimeout time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	BufSize      uint
+	Breaker      *CircuitBreaker
+
+	client *libhoney.Client
+	sender transmission.Sender
+	// pending is the number of events sent or waiting to be retried
+	// that libhoney hasn't yet responded to for the last time. Send
+	// keeps it within BufSize so that libhoney's queue never overflows
+	// partway through a trace
+	pending int64
+	// lock guards stopped and sending events, so that nothing is
+	// sent or retried once Stop starts closing the client
+	lock    sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewHoneycombForwarder creates a HoneycombForwarder for a dataset
+func NewHoneycombForwarder(apiHost string, dataset string, writeKey string) (*HoneycombForwarder, error) {
+	if dataset == "" {
+		return nil, errors.New("honeycomb dataset must not be empty")
+	}
+	if writeKey == "" {
+		return nil, errors.New("honeycomb write key must not be empty")
+	}
+	forwarder := new(HoneycombForwarder)
+	forwarder.Name = "honeycomb"
+	forwarder.APIHost = apiHost
+	forwarder.Dataset = dataset
+	forwarder.WriteKey = writeKey
+	return forwarder, nil
+}
+
+// Start creates the libhoney client and starts processing responses
+func (f *HoneycombForwarder) Start() error {
+	if f.BatchSize == 0 {
+		f.BatchSize = libhoney.DefaultMaxBatchSize
+	}
+	if f.BatchTimeout == 0 {
+		f.BatchTimeout = libhoney.DefaultBatchTimeout
+	}
+	if f.BufSize == 0 {
+		f.BufSize = libhoney.DefaultPendingWorkCapacity
+	}
+	if f.RetryBackoff == 0 {
+		f.RetryBackoff = defaultHoneycombRetryBackoff
+	}
+	if f.sender == nil {
+		f.sender = &transmission.Honeycomb{
+			MaxBatchSize:         f.BatchSize,
+			BatchTimeout:         f.BatchTimeout,
+			MaxConcurrentBatches: libhoney.DefaultMaxConcurrentBatches,
+			PendingWorkCapacity:  f.BufSize,
+			UserAgentAddition:    "otre",
+			Metrics:              &honeycombMetrics{destination: f.Name},
+		}
+	}
+	if f.Breaker == nil {
+		f.Breaker = NewCircuitBreaker(f.Name, defaultFailureThreshold, defaultOpenTimeout)
+	}
+	destinationQueueCapacity.WithLabelValues(f.Name).Set(float64(f.BufSize))
+	var err error
+	f.client, err = libhoney.NewClient(libhoney.ClientConfig{
+		APIKey:       f.WriteKey,
+		Dataset:      f.Dataset,
+		APIHost:      f.APIHost,
+		Transmission: f.sender,
+	})
+	if err != nil {
+		return err
+	}
+	f.wg.Add(1)
+	go f.runResponses()
+	return nil
+}
+
+// Stop flushes any outstanding events and closes the client
+func (f *HoneycombForwarder) Stop() error {
+	f.lock.Lock()
+	f.stopped = true
+	f.lock.Unlock()
+	if f.client == nil {
+		return nil
+	}
+	f.client.Close()
+	f.wg.Wait()
+	return nil
+}
+
+// Circuit returns the circuit breaker guarding the honeycomb API
+func (f *HoneycombForwarder) Circuit() *CircuitBreaker {
+	return f.Breaker
+}
+
+func (f *HoneycombForwarder) runResponses() {
+	for resp := range f.client.TxResponses() {
+		event, ok := resp.Metadata.(honeycombEvent)
+		if !ok {
+			continue
+		}
+		destinationInFlight.WithLabelValues(f.Name).Dec()
+		if resp.Err != nil && resp.Err.Error() == honeycombQueueOverflow {
+			// counted as dropped by honeycombMetrics, and never sent,
+			// so neither an API error nor worth retrying
+			atomic.AddInt64(&f.pending, -1)
+			continue
+		}
+		destinationLatency.WithLabelValues(f.Name).Observe(resp.Duration.Seconds())
+		if resp.Err != nil {
+			destinationResponses.WithLabelValues(f.Name, "error").Inc()
+		} else {
+			destinationResponses.WithLabelValues(f.Name, strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		if resp.Err == nil && resp.StatusCode == http.StatusAccepted {
+			atomic.AddInt64(&f.pending, -1)
+			f.Breaker.Success()
+			honeycombEventsSent.Inc()
+			continue
+		}
+		f.Breaker.Failure()
+		if event.attempt < f.MaxRetries && !f.Breaker.Open() {
+			event.attempt++
+			time.AfterFunc(f.retryDelay(event.attempt), func() { f.retry(event) })
+			continue
+		}
+		atomic.AddInt64(&f.pending, -1)
+		honeycombSendErrors.Inc()
+		logrus.WithError(resp.Err).
+			WithField("status", resp.StatusCode).
+			WithField("response", string(resp.Body)).
+			Info("Error sending event to honeycomb")
+	}
+	f.wg.Done()
+}
+
+// retryDelay returns how long to wait before an attempt to resend a
+// failed event, doubling RetryBackoff for each attempt after the first
+func (f *HoneycombForwarder) retryDelay(attempt int) time.Duration {
+	return f.RetryBackoff << uint(attempt-1)
+}
+
+// retry resends a failed event, giving up if the forwarder has
+// stopped in the meantime
+func (f *HoneycombForwarder) retry(event honeycombEvent) {
+	err := f.send(event)
+	if err == nil {
+		destinationRetries.WithLabelValues(f.Name).Inc()
+		return
+	}
+	atomic.AddInt64(&f.pending, -1)
+	honeycombSendErrors.Inc()
+	logrus.WithError(err).Info("Error resending event to honeycomb")
+}
+
+// honeycombSampleRate converts a percentage sample rate as used by
+// policies into honeycomb's one in N sample rate
+func honeycombSampleRate(sampleRate int) uint {
+	if sampleRate <= 0 || sampleRate >= 100 {
+		return 1
+	}
+	return uint((100 + sampleRate/2) / sampleRate)
+}
+
+// send sends an event unless the forwarder is stopped
+func (f *HoneycombForwarder) send(event honeycombEvent) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.stopped {
+		return errSinkStopped
+	}
+	return f.sendEvent(event)
+}
+
+func (f *HoneycombForwarder) sendEvent(event honeycombEvent) error {
+	ev := f.client.NewEvent()
+	ev.Timestamp = event.span.Timestamp
+	ev.SampleRate = event.sampleRate
+	ev.Metadata = event
+	ev.Add(event.span.CoreSpanMetadata)
+	for k, v := range event.span.BinaryAnnotations {
+		ev.AddField(k, v)
+	}
+	destinationInFlight.WithLabelValues(f.Name).Inc()
+	if err := ev.SendPresampled(); err != nil {
+		destinationInFlight.WithLabelValues(f.Name).Dec()
+		return err
+	}
+	return nil
+}
+
+// Send queues an event for each span in a payload, using
+// the payload's sample rate to weight the events. The events are
+// queued together or not at all, so that a full queue never leaves
+// part of a trace to be sent again when the trace is retried
+func (f *HoneycombForwarder) Send(p payload) error {
+	// Send takes the write lock so that only one trace at a time
+	// reserves space, while retries only reuse space already reserved
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped {
+		return dropped(f.Name, errSinkStopped)
+	}
+	if len(p.Spans) > int(f.BufSize) {
+		return dropped(f.Name, errTraceTooLarge)
+	}
+	if !f.Breaker.Allow() {
+		return dropped(f.Name, errCircuitOpen)
+	}
+	if atomic.LoadInt64(&f.pending)+int64(len(p.Spans)) > int64(f.BufSize) {
+		return dropped(f.Name, errSinkFull)
+	}
+	atomic.AddInt64(&f.pending, int64(len(p.Spans)))
+	sampleRate := honeycombSampleRate(p.SampleRate)
+	for _, span := range p.Spans {
+		if err := f.sendEvent(honeycombEvent{span: span, sampleRate: sampleRate}); err != nil {
+			atomic.AddInt64(&f.pending, -1)
+			logrus.WithError(err).Info("Error sending event to honeycomb")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type honeycombBatchEvent struct {
+	SampleRate uint                   `json:"samplerate"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// fakeHoneycomb stands in for the honeycomb batch API, failing
+// the first failures batches it receives
+type fakeHoneycomb struct {
+	sync.Mutex
+	failures int
+	events   []honeycombBatchEvent
+}
+
+func (h *fakeHoneycomb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if r.URL.Path != "/1/batch/traces" || r.Header.Get("X-Honeycomb-Team") != "key" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if h.failures > 0 {
+		h.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "zstd" {
+		decoder, err := zstd.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer decoder.Close()
+		body = decoder
+	}
+	var batch []honeycombBatchEvent
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, batch...)
+	statuses := make([]map[string]int, len(batch))
+	for i := range batch {
+		statuses[i] = map[string]int{"status": http.StatusAccepted}
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func TestHoneycombSampleRate(t *testing.T) {
+	for rate, expected := range map[int]uint{0: 1, 100: 1, 50: 2, 25: 4, 30: 3, 1: 100} {
+		if result := honeycombSampleRate(rate); result != expected {
+			t.Errorf("Sample rate of %d%% should be 1 in %d, not %d", rate, expected, result)
+		}
+	}
+}
+
+func TestHoneycombForwarder(t *testing.T) {
+	fake := &fakeHoneycomb{failures: 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if _, err := NewHoneycombForwarder(server.URL, "traces", ""); err == nil {
+		t.Errorf("Missing write key should return an error")
+	}
+	forwarder, err := NewHoneycombForwarder(server.URL, "traces", "key")
+	if err != nil {
+		t.Fatalf("Couldn't create honeycomb forwarder: %v", err)
+	}
+	forwarder.BatchTimeout = time.Millisecond
+	forwarder.MaxRetries = 1
+	forwarder.RetryBackoff = time.Millisecond
+	if err := forwarder.Start(); err != nil {
+		t.Fatalf("Couldn't start honeycomb forwarder: %v", err)
+	}
+
+	sent := testutil.ToFloat64(honeycombEventsSent)
+	retries := testutil.ToFloat64(destinationRetries.WithLabelValues("honeycomb"))
+	err = forwarder.Send(payload{
+		TraceID:    "trace",
+		SampleRate: 25,
+		Spans: []types.Span{
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "root", Name: "/api"}, BinaryAnnotations: map[string]interface{}{"http.status_code": 200}},
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "child", ParentID: "root", Name: "db"}},
+		},
+	})
+	if err != nil {
+		t.Errorf("Couldn't send payload to honeycomb: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(honeycombEventsSent)-sent < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	forwarder.Stop()
+
+	if got := testutil.ToFloat64(destinationRetries.WithLabelValues("honeycomb")) - retries; got != 2 {
+		t.Errorf("Both events should have been retried once, got %v retries", got)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.events) != 2 {
+		t.Fatalf("Expected two events to reach honeycomb, got %d", len(fake.events))
+	}
+	for _, event := range fake.events {
+		if event.SampleRate != 4 {
+			t.Errorf("Event sample rate should be 4 for a 25%% sample rate, not %d", event.SampleRate)
+		}
+		if event.Data["traceId"] != "trace" {
+			t.Errorf("Event should contain span metadata, got %v", event.Data)
+		}
+	}
+	if err := forwarder.Send(payload{}); err == nil {
+		t.Errorf("Sending to a stopped forwarder should return an error")
+	}
+}
+
+// fakeSender stands in for a libhoney transmission, responding to
+// each event with err, or holding events without responding while
+// err is nil
+type fakeSender struct {
+	sync.Mutex
+	added     int
+	err       error
+	responses chan transmission.Response
+}
+
+func (s *fakeSender) Add(ev *transmission.Event) {
+	s.Lock()
+	s.added++
+	s.Unlock()
+	if s.err != nil {
+		s.responses <- transmission.Response{Err: s.err, Metadata: ev.Metadata}
+	}
+}
+
+func (s *fakeSender) Start() error { return nil }
+
+func (s *fakeSender) Stop() error {
+	close(s.responses)
+	return nil
+}
+
+func (s *fakeSender) TxResponses() chan transmission.Response { return s.responses }
+
+func (s *fakeSender) SendResponse(r transmission.Response) bool {
+	s.responses <- r
+	return false
+}
+
+func TestHoneycombQueueOverflow(t *testing.T) {
+	sender := &fakeSender{err: errors.New(honeycombQueueOverflow), responses: make(chan transmission.Response, 10)}
+	forwarder, err := NewHoneycombForwarder("http://localhost", "traces", "key")
+	if err != nil {
+		t.Fatalf("Couldn't create honeycomb forwarder: %v", err)
+	}
+	forwarder.MaxRetries = 3
+	forwarder.sender = sender
+	if err := forwarder.Start(); err != nil {
+		t.Fatalf("Couldn't start honeycomb forwarder: %v", err)
+	}
+	errors := testutil.ToFloat64(honeycombSendErrors)
+	retries := testutil.ToFloat64(destinationRetries.WithLabelValues("honeycomb"))
+	span := types.Span{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "root"}}
+	if err := forwarder.Send(payload{TraceID: "trace", Spans: []types.Span{span}}); err != nil {
+		t.Errorf("Couldn't send payload to honeycomb: %v", err)
+	}
+	forwarder.Stop()
+
+	if sender.added != 1 {
+		t.Errorf("An event dropped by a full queue should not be retried, got %d attempts", sender.added)
+	}
+	if got := testutil.ToFloat64(honeycombSendErrors) - errors; got != 0 {
+		t.Errorf("An event dropped by a full queue should not count as a send error, got %v", got)
+	}
+	if got := testutil.ToFloat64(destinationRetries.WithLabelValues("honeycomb")) - retries; got != 0 {
+		t.Errorf("An event dropped by a full queue should not count as a retry, got %v", got)
+	}
+}
+
+func TestHoneycombSendQueuesWholeTrace(t *testing.T) {
+	sender := &fakeSender{responses: make(chan transmission.Response, 10)}
+	forwarder, err := NewHoneycombForwarder("http://localhost", "traces", "key")
+	if err != nil {
+		t.Fatalf("Couldn't create honeycomb forwarder: %v", err)
+	}
+	forwarder.BufSize = 3
+	forwarder.sender = sender
+	if err := forwarder.Start(); err != nil {
+		t.Fatalf("Couldn't start honeycomb forwarder: %v", err)
+	}
+	defer forwarder.Stop()
+	spans := func(n int) []types.Span {
+		spans := make([]types.Span, n)
+		for i := range spans {
+			spans[i] = types.Span{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: fmt.Sprint(i)}}
+		}
+		return spans
+	}
+	if err := forwarder.Send(payload{TraceID: "trace", Spans: spans(2)}); err != nil {
+		t.Errorf("A trace that fits should be queued, got %v", err)
+	}
+	if err := forwarder.Send(payload{TraceID: "trace", Spans: spans(2)}); err != errSinkFull {
+		t.Errorf("Sending more spans than the queue has room for should return %v, not %v", errSinkFull, err)
+	}
+	if err := forwarder.Send(payload{TraceID: "trace", Spans: spans(4)}); err != errTraceTooLarge {
+		t.Errorf("Sending more spans than the queue can hold should return %v, not %v", errTraceTooLarge, err)
+	}
+	sender.Lock()
+	defer sender.Unlock()
+	if sender.added != 2 {
+		t.Errorf("Traces that don't fit should not be partly queued, got %d events", sender.added)
+	}
+}
+
+func TestHoneycombRetryDelay(t *testing.T) {
+	forwarder := &HoneycombForwarder{RetryBackoff: 100 * time.Millisecond}
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if delay := forwarder.retryDelay(attempt); delay != expected {
+			t.Errorf("Retry %d should wait %v, not %v", attempt, expected, delay)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	kafkaMessagesDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_kafka_messages_delivered_total",
+		Help: "The total number of messages acknowledged by the kafka brokers",
+	})
+	kafkaDeliveryErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_kafka_delivery_errors_total",
+		Help: "The total number of messages that could not be delivered to kafka",
+	})
+)
+
+// KafkaForwarder sends traces to a kafka topic, keyed by trace ID
+// so that all spans of a trace land on the same partition
+type KafkaForwarder struct {
+	Name    string
+	Brokers []string
+	Topic   string
+	// Encoding is either "json", which sends one message per trace
+	// containing a JSON array of spans, or "json-span", which sends one
+	// JSON message per span
+	Encoding    string
+	Compression string
+	Acks        string
+	BufSize     int
+	Breaker     *CircuitBreaker
+
+	config   *sarama.Config
+	producer sarama.AsyncProducer
+	messages chan *sarama.ProducerMessage
+	// lock guards stopped and sending on messages, so that Send
+	// can't race with Stop closing messages
+	lock    sync.Mutex
+	stopped bool
+	queued  sync.WaitGroup
+	wg      sync.WaitGroup
+}
+
+// NewKafkaForwarder creates a KafkaForwarder from a comma separated
+// list of brokers and a topic
+func NewKafkaForwarder(brokers string, topic string) (*KafkaForwarder, error) {
+	if topic == "" {
+		return nil, errors.New("kafka topic must not be empty")
+	}
+	forwarder := new(KafkaForwarder)
+	forwarder.Name = "kafka"
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			forwarder.Brokers = append(forwarder.Brokers, broker)
+		}
+	}
+	if len(forwarder.Brokers) == 0 {
+		return nil, fmt.Errorf("invalid kafka broker list %s", brokers)
+	}
+	forwarder.Topic = topic
+	return forwarder, nil
+}
+
+func kafkaCompression(compression string) (sarama.CompressionCodec, sarama.KafkaVersion, error) {
+	switch compression {
+	case "", "none":
+		return sarama.CompressionNone, sarama.MinVersion, nil
+	case "gzip":
+		return sarama.CompressionGZIP, sarama.MinVersion, nil
+	case "snappy":
+		return sarama.CompressionSnappy, sarama.MinVersion, nil
+	case "lz4":
+		return sarama.CompressionLZ4, sarama.V0_10_0_0, nil
+	case "zstd":
+		return sarama.CompressionZSTD, sarama.V2_1_0_0, nil
+	}
+	return sarama.CompressionNone, sarama.MinVersion, fmt.Errorf("unknown kafka compression %s", compression)
+}
+
+func kafkaAcks(acks string) (sarama.RequiredAcks, error) {
+	switch acks {
+	case "none":
+		return sarama.NoResponse, nil
+	case "", "leader":
+		return sarama.WaitForLocal, nil
+	case "all":
+		return sarama.WaitForAll, nil
+	}
+	return sarama.NoResponse, fmt.Errorf("unknown kafka acks %s, must be one of none, leader or all", acks)
+}
+
+func (f *KafkaForwarder) buildConfig() (*sarama.Config, error) {
+	var err error
+	config := sarama.NewConfig()
+	config.ClientID = "otre"
+	config.Producer.Compression, config.Version, err = kafkaCompression(f.Compression)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.RequiredAcks, err = kafkaAcks(f.Acks)
+	if err != nil {
+		return nil, err
+	}
+	switch f.Encoding {
+	case "":
+		f.Encoding = "json"
+	case "json", "json-span":
+	default:
+		return nil, fmt.Errorf("unknown kafka encoding %s, must be json or json-span", f.Encoding)
+	}
+	if f.BufSize == 0 {
+		f.BufSize = 4096
+	}
+	config.ChannelBufferSize = f.BufSize
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	return config, config.Validate()
+}
+
+// Start connects to the kafka brokers and starts recording
+// the results of message deliveries
+func (f *KafkaForwarder) Start() error {
+	var err error
+	if f.config == nil {
+		f.config, err = f.buildConfig()
+		if err != nil {
+			return err
+		}
+	}
+	if f.Breaker == nil {
+		f.Breaker = NewCircuitBreaker(f.Name, defaultFailureThreshold, defaultOpenTimeout)
+	}
+	f.producer, err = sarama.NewAsyncProducer(f.Brokers, f.config)
+	if err != nil {
+		return err
+	}
+	f.messages = make(chan *sarama.ProducerMessage, f.BufSize)
+	destinationQueueCapacity.WithLabelValues(f.Name).Set(float64(f.BufSize))
+	f.queued.Add(1)
+	go f.runInput()
+	f.wg.Add(2)
+	go f.runSuccesses()
+	go f.runErrors()
+	return nil
+}
+
+// Stop flushes any buffered messages and closes the producer
+func (f *KafkaForwarder) Stop() error {
+	f.lock.Lock()
+	stopped := f.stopped
+	f.stopped = true
+	if f.producer == nil || stopped {
+		f.lock.Unlock()
+		return nil
+	}
+	close(f.messages)
+	f.lock.Unlock()
+	f.queued.Wait()
+	f.producer.AsyncClose()
+	f.wg.Wait()
+	return nil
+}
+
+// Circuit returns the circuit breaker guarding the kafka brokers
+func (f *KafkaForwarder) Circuit() *CircuitBreaker {
+	return f.Breaker
+}
+
+func (f *KafkaForwarder) runInput() {
+	for message := range f.messages {
+		destinationQueueLength.WithLabelValues(f.Name).Set(float64(len(f.messages)))
+		destinationInFlight.WithLabelValues(f.Name).Inc()
+		message.Metadata = time.Now()
+		f.producer.Input() <- message
+	}
+	f.queued.Done()
+}
+
+// delivered records the outcome of a message that the producer
+// has finished with
+func (f *KafkaForwarder) delivered(message *sarama.ProducerMessage, code string) {
+	destinationInFlight.WithLabelValues(f.Name).Dec()
+	destinationResponses.WithLabelValues(f.Name, code).Inc()
+	if start, ok := message.Metadata.(time.Time); ok {
+		destinationLatency.WithLabelValues(f.Name).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (f *KafkaForwarder) runSuccesses() {
+	for message := range f.producer.Successes() {
+		f.delivered(message, "ok")
+		f.Breaker.Success()
+		destinationBytesSent.WithLabelValues(f.Name).Add(float64(message.Value.Length()))
+		kafkaMessagesDelivered.Inc()
+	}
+	f.wg.Done()
+}
+
+func (f *KafkaForwarder) runErrors() {
+	for err := range f.producer.Errors() {
+		f.delivered(err.Msg, "error")
+		f.Breaker.Failure()
+		kafkaDeliveryErrors.Inc()
+		logrus.WithError(err.Err).WithField("topic", err.Msg.Topic).Info("Error sending message to kafka")
+	}
+	f.wg.Done()
+}
+
+func (f *KafkaForwarder) buildMessages(p payload) ([]*sarama.ProducerMessage, error) {
+	key := sarama.StringEncoder(p.TraceID)
+	if f.Encoding != "json-span" {
+		return []*sarama.ProducerMessage{{Topic: f.Topic, Key: key, Value: sarama.ByteEncoder(p.Body)}}, nil
+	}
+	messages := make([]*sarama.ProducerMessage, len(p.Spans))
+	for i, span := range p.Spans {
+		body, err := json.Marshal(span)
+		if err != nil {
+			return nil, err
+		}
+		messages[i] = &sarama.ProducerMessage{Topic: f.Topic, Key: key, Value: sarama.ByteEncoder(body)}
+	}
+	return messages, nil
+}
+
+// Send queues a payload for delivery to kafka. The payload's messages
+// are queued together or not at all, so a full queue never leaves part
+// of a trace queued. A trace with more spans than the queue can ever
+// hold is rejected with errTraceTooLarge rather than errSinkFull
+func (f *KafkaForwarder) Send(p payload) error {
+	messages, err := f.buildMessages(p)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped {
+		return dropped(f.Name, errSinkStopped)
+	}
+	if len(messages) > cap(f.messages) {
+		return dropped(f.Name, errTraceTooLarge)
+	}
+	if !f.Breaker.Allow() {
+		return dropped(f.Name, errCircuitOpen)
+	}
+	// only Send adds to messages, so the space available can't shrink
+	// while the lock is held
+	if cap(f.messages)-len(f.messages) < len(messages) {
+		return dropped(f.Name, errSinkFull)
+	}
+	for _, message := range messages {
+		f.messages <- message
+	}
+	destinationQueueLength.WithLabelValues(f.Name).Set(float64(len(f.messages)))
+	return nil
+}
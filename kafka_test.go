@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestKafkaForwarder(t *testing.T, produceResponse sarama.MockResponse) (*KafkaForwarder, *sarama.MockBroker) {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("traces", 0, broker.BrokerID()),
+		"ProduceRequest": produceResponse,
+	})
+	forwarder, err := NewKafkaForwarder(broker.Addr(), "traces")
+	if err != nil {
+		t.Fatalf("Couldn't create kafka forwarder: %v", err)
+	}
+	return forwarder, broker
+}
+
+func TestKafkaMessagesKeyedByTraceID(t *testing.T) {
+	forwarder, err := NewKafkaForwarder("localhost:9092", "traces")
+	if err != nil {
+		t.Fatalf("Couldn't create kafka forwarder: %v", err)
+	}
+	p := payload{
+		Body:    []byte("[]"),
+		TraceID: "trace",
+		Spans: []types.Span{
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "root"}},
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "child", ParentID: "root"}},
+		},
+	}
+	for encoding, expected := range map[string]int{"json": 1, "json-span": 2} {
+		forwarder.Encoding = encoding
+		messages, err := forwarder.buildMessages(p)
+		if err != nil {
+			t.Fatalf("Couldn't build %s messages: %v", encoding, err)
+		}
+		if len(messages) != expected {
+			t.Errorf("%s encoding should produce %d messages, not %d", encoding, expected, len(messages))
+		}
+		for _, message := range messages {
+			if message.Key != sarama.StringEncoder("trace") {
+				t.Errorf("kafka message should be keyed by trace ID, not %v", message.Key)
+			}
+		}
+	}
+}
+
+func TestKafkaSendQueuesWholeTrace(t *testing.T) {
+	forwarder, err := NewKafkaForwarder("localhost:9092", "traces")
+	if err != nil {
+		t.Fatalf("Couldn't create kafka forwarder: %v", err)
+	}
+	forwarder.Encoding = "json-span"
+	forwarder.Breaker = NewCircuitBreaker(forwarder.Name, defaultFailureThreshold, defaultOpenTimeout)
+	forwarder.messages = make(chan *sarama.ProducerMessage, 2)
+	forwarder.messages <- &sarama.ProducerMessage{}
+	p := payload{
+		TraceID: "trace",
+		Spans: []types.Span{
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "root"}},
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "child", ParentID: "root"}},
+		},
+	}
+	if err := forwarder.Send(p); err != errSinkFull {
+		t.Errorf("Sending more spans than the queue has room for should return %v, not %v", errSinkFull, err)
+	}
+	if len(forwarder.messages) != 1 {
+		t.Errorf("A trace that doesn't fit should not be partly queued, found %d messages", len(forwarder.messages))
+	}
+	<-forwarder.messages
+	if err := forwarder.Send(p); err != nil {
+		t.Errorf("A trace that fits should be queued, got %v", err)
+	}
+}
+
+func TestKafkaSendRejectsTraceLargerThanQueue(t *testing.T) {
+	forwarder, err := NewKafkaForwarder("localhost:9092", "traces")
+	if err != nil {
+		t.Fatalf("Couldn't create kafka forwarder: %v", err)
+	}
+	forwarder.Encoding = "json-span"
+	forwarder.Breaker = NewCircuitBreaker(forwarder.Name, defaultFailureThreshold, defaultOpenTimeout)
+	forwarder.messages = make(chan *sarama.ProducerMessage, 1)
+	p := payload{
+		TraceID: "trace",
+		Spans: []types.Span{
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "root"}},
+			{CoreSpanMetadata: types.CoreSpanMetadata{TraceID: "trace", ID: "child", ParentID: "root"}},
+		},
+	}
+	before := testutil.ToFloat64(destinationDropped.WithLabelValues("kafka", errTraceTooLarge.Error()))
+	if err := forwarder.Send(p); err != errTraceTooLarge {
+		t.Errorf("Sending more spans than the queue can hold should return %v, not %v", errTraceTooLarge, err)
+	}
+	if dropped := testutil.ToFloat64(destinationDropped.WithLabelValues("kafka", errTraceTooLarge.Error())) - before; dropped != 1 {
+		t.Errorf("Expected one trace dropped as too large, got %v", dropped)
+	}
+}
+
+func TestKafkaInvalidConfig(t *testing.T) {
+	if _, err := NewKafkaForwarder(" , ", "traces"); err == nil {
+		t.Errorf("Empty broker list should return an error")
+	}
+	for _, forwarder := range []*KafkaForwarder{
+		{Brokers: []string{"localhost:9092"}, Topic: "traces", Compression: "brotli"},
+		{Brokers: []string{"localhost:9092"}, Topic: "traces", Acks: "some"},
+		{Brokers: []string{"localhost:9092"}, Topic: "traces", Encoding: "thrift"},
+	} {
+		if err := forwarder.Start(); err == nil {
+			t.Errorf("Invalid kafka configuration %+v should fail to start", forwarder)
+		}
+	}
+}
+
+func TestKafkaDelivery(t *testing.T) {
+	for _, test := range []struct {
+		response  func(t *testing.T) sarama.MockResponse
+		delivered float64
+		errors    float64
+	}{
+		{
+			response:  func(t *testing.T) sarama.MockResponse { return sarama.NewMockProduceResponse(t) },
+			delivered: 1,
+		},
+		{
+			response: func(t *testing.T) sarama.MockResponse {
+				return sarama.NewMockProduceResponse(t).SetError("traces", 0, sarama.ErrMessageSizeTooLarge)
+			},
+			errors: 1,
+		},
+	} {
+		delivered := testutil.ToFloat64(kafkaMessagesDelivered)
+		errors := testutil.ToFloat64(kafkaDeliveryErrors)
+		forwarder, broker := newTestKafkaForwarder(t, test.response(t))
+		forwarder.Compression = "gzip"
+		if err := forwarder.Start(); err != nil {
+			t.Fatalf("Couldn't start kafka forwarder: %v", err)
+		}
+		if err := forwarder.Send(payload{Body: []byte("[]"), TraceID: "trace"}); err != nil {
+			t.Errorf("Couldn't send payload to kafka: %v", err)
+		}
+		forwarder.Stop()
+		broker.Close()
+		if got := testutil.ToFloat64(kafkaMessagesDelivered) - delivered; got != test.delivered {
+			t.Errorf("Expected %v messages delivered, got %v", test.delivered, got)
+		}
+		if got := testutil.ToFloat64(kafkaDeliveryErrors) - errors; got != test.errors {
+			t.Errorf("Expected %v delivery errors, got %v", test.errors, got)
+		}
+		if err := forwarder.Send(payload{}); err == nil {
+			t.Errorf("Sending to a stopped forwarder should return an error")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	mirroredRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otre_mirror_requests_total",
+		Help: "The total number of inbound requests queued for the mirror",
+	})
+	mirrorQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otre_mirror_queue_length",
+		Help: "The number of requests waiting to be sent to the mirror",
+	})
+)
+
+// NewMirror creates a Forwarder that sends every inbound request
+// to the same path on the mirror host
+func NewMirror(mirror string) (*Forwarder, error) {
+	downstreamURL, err := parseDownstreamURL(mirror)
+	if err != nil {
+		return nil, err
+	}
+	forwarder := new(Forwarder)
+	forwarder.Name = "mirror"
+	forwarder.DownstreamURL = downstreamURL
+	forwarder.PreservePath = true
+	return forwarder, nil
+}
+
+// mirrorWrap wraps a handleFunc and queues the request body, verbatim
+// and before any sampling, to be sent to the mirror
+func (a *app) mirrorWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.mirror == nil {
+			hf(w, r)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			logrus.WithError(err).Error("Error reading request body")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error reading request"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		err = a.mirror.Send(payload{
+			ContentType:     r.Header.Get("Content-Type"),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+			Path:            r.URL.Path,
+			Body:            data,
+		})
+		// requests that can't be queued are counted by Send in
+		// otre_destination_dropped_total
+		if err != nil {
+			logrus.WithError(err).Debug("Error mirroring request")
+		} else {
+			mirroredRequests.Inc()
+		}
+		mirrorQueueLength.Set(float64(a.mirror.QueueLength()))
+		hf(w, r)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type mirroredRequest struct {
+	path            string
+	contentEncoding string
+	body            string
+}
+
+func TestMirrorWrap(t *testing.T) {
+	received := make(chan mirroredRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- mirroredRequest{path: r.URL.Path, contentEncoding: r.Header.Get("Content-Encoding"), body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	mirror, err := NewMirror(server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't create mirror: %v", err)
+	}
+	mirror.Start()
+	defer mirror.Stop()
+	a := &app{mirror: mirror}
+
+	var handled string
+	handler := a.mirrorWrap(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		handled = string(body)
+	})
+	r := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader("compressed spans"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	handler(httptest.NewRecorder(), r)
+
+	if handled != "compressed spans" {
+		t.Errorf("Wrapped handler should still receive the request body, got %q", handled)
+	}
+	select {
+	case request := <-received:
+		expected := mirroredRequest{path: "/api/v2/spans", contentEncoding: "gzip", body: "compressed spans"}
+		if request != expected {
+			t.Errorf("Mirror should receive the request verbatim (%+v), got %+v", expected, request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mirror did not receive the request")
+	}
+}
+
+func TestMirrorWrapDropped(t *testing.T) {
+	mirror, err := NewMirror("http://localhost")
+	if err != nil {
+		t.Fatalf("Couldn't create mirror: %v", err)
+	}
+	mirror.Start()
+	mirror.Stop()
+	a := &app{mirror: mirror}
+
+	dropped := destinationDropped.WithLabelValues("mirror", errSinkStopped.Error())
+	before := testutil.ToFloat64(dropped)
+	a.mirrorWrap(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader("spans")))
+	if got := testutil.ToFloat64(dropped) - before; got != 1 {
+		t.Errorf("A request the mirror can't queue should be counted as dropped once, got %v", got)
+	}
+}
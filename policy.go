@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/willthames/otre/rules"
+)
+
+var (
+	policyInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otre_policy_info",
+		Help: "Always 1, labelled with the sha256 hash and bundle revision of the active policy",
+	}, []string{"sha256", "revision"})
+	policyReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_policy_reloads_total",
+		Help: "The total number of policy reloads by trigger and result",
+	}, []string{"trigger", "result"})
+	policyLastReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otre_policy_last_reload_success",
+		Help: "Whether the last policy reload succeeded",
+	})
+	policyLastReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "otre_policy_last_reload_timestamp_seconds",
+		Help: "The time of the last policy reload attempt",
+	})
+	policyBundleFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_policy_bundle_fetches_total",
+		Help: "The total number of requests to the policy bundle server by result",
+	}, []string{"result"})
+)
+
+// bundleClient downloads policy bundles from the bundle server
+var bundleClient = &http.Client{Timeout: 30 * time.Second}
+
+// activatePolicy records the hash and revision of the policy now in use
+func (a *app) activatePolicy(hash, revision string) {
+	if a.policyHash != "" {
+		policyInfo.DeleteLabelValues(a.policyHash, a.policyRevision)
+	}
+	a.policyHash, a.policyRevision = hash, revision
+	policyInfo.WithLabelValues(hash, revision).Set(1)
+}
+
+// configureEngine applies the evaluation timeout and fallback
+// decision to a rules engine, naming it in evaluation metrics
+func (a *app) configureEngine(re *rules.RulesEngine, name string) {
+	re.Name = name
+	re.Timeout = a.policyTimeout
+	if a.policyFallback != nil {
+		re.Fallback = *a.policyFallback
+	}
+}
+
+// policySource returns where the policy is loaded from
+func (a *app) policySource() string {
+	if a.policyBundleURL != "" {
+		return a.policyBundleURL
+	}
+	return a.policyFile
+}
+
+// loadPolicy loads the policy from the policy file, or downloads it
+// from the bundle server along with its ETag. It returns a nil policy
+// if the bundle server reports that the bundle hasn't changed. The
+// caller stores the ETag once the policy is in use, so that a bundle
+// that fails to load is fetched again
+func (a *app) loadPolicy() (*rules.Policy, string, error) {
+	if a.policyBundleURL == "" {
+		policy, err := rules.LoadPolicy(a.policyFile)
+		return policy, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, a.policyBundleURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if a.policyBundleETag != "" {
+		req.Header.Set("If-None-Match", a.policyBundleETag)
+	}
+	resp, err := bundleClient.Do(req)
+	if err != nil {
+		policyBundleFetches.WithLabelValues("error").Inc()
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		policyBundleFetches.WithLabelValues("not_modified").Inc()
+		return nil, "", nil
+	case http.StatusOK:
+	default:
+		policyBundleFetches.WithLabelValues("error").Inc()
+		return nil, "", fmt.Errorf("bundle server returned %s", resp.Status)
+	}
+	policy, err := rules.ReadBundle(resp.Body, a.policyVerifier)
+	if err != nil {
+		policyBundleFetches.WithLabelValues("error").Inc()
+		return nil, "", err
+	}
+	policyBundleFetches.WithLabelValues("success").Inc()
+	return policy, resp.Header.Get("ETag"), nil
+}
+
+// reloadPolicy loads the policy and, if it has changed, replaces the
+// policy used by the rules engine along with its revision. If the new
+// policy fails to load or compile the current policy stays active. Any
+// shadow policy is reloaded at the same time
+func (a *app) reloadPolicy(trigger string) (string, error) {
+	a.policyLock.Lock()
+	defer a.policyLock.Unlock()
+
+	if a.shadowPolicyFile != "" {
+		previous := a.shadowError
+		// as for the active policy, an unchanged error is only
+		// reported once while watching
+		if err := a.loadShadowPolicy(); err != nil && (trigger != "watch" || previous == nil || err.Error() != previous.Error()) {
+			logrus.WithError(err).WithField("shadowPolicy", a.shadowPolicyFile).WithField("trigger", trigger).Error("Error reloading shadow policy, keeping current shadow policy")
+		}
+	}
+	policy, etag, err := a.loadPolicy()
+	if err == nil {
+		if policy == nil {
+			a.policyError = ""
+			return a.policyHash, nil
+		}
+		hash := policy.Hash()
+		if hash == a.policyHash {
+			a.policyBundleETag, a.policyError = etag, ""
+			return hash, nil
+		}
+		err = a.re.Reload(policy)
+		if err == nil {
+			a.activatePolicy(hash, policy.Revision)
+			a.policyBundleETag = etag
+		}
+	}
+	if err != nil && trigger == "watch" && err.Error() == a.policyError {
+		// the policy hasn't changed since this error was reported
+		return a.policyHash, err
+	}
+	policyLastReloadTime.Set(float64(time.Now().Unix()))
+	if err != nil {
+		a.policyError = err.Error()
+		logrus.WithError(err).WithField("policy", a.policySource()).WithField("trigger", trigger).Error("Error reloading policy, keeping current policy")
+		policyReloads.WithLabelValues(trigger, "error").Inc()
+		policyLastReloadSuccess.Set(0)
+		return a.policyHash, err
+	}
+	a.policyError = ""
+	logrus.WithField("policy", a.policySource()).WithField("sha256", a.policyHash).WithField("revision", a.policyRevision).WithField("trigger", trigger).Info("Reloaded policy")
+	policyReloads.WithLabelValues(trigger, "success").Inc()
+	policyLastReloadSuccess.Set(1)
+	return a.policyHash, nil
+}
+
+// watchPolicy reloads the policy whenever the policy file, directory
+// or bundle changes, polling the bundle server if one is configured.
+// A policy that fails to reload is only reported again once the error
+// changes
+func (a *app) watchPolicy(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.reloadPolicy("watch")
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// reloadOnHangup reloads the policy whenever otre receives SIGHUP
+func (a *app) reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+			a.reloadPolicy("signal")
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// handleReload handles the /admin/reload POST endpoint, reloading
+// the policy and responding with the hash of the active policy
+func (a *app) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hash, err := a.reloadPolicy("admin")
+	response := map[string]string{"sha256": hash}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		response["error"] = err.Error()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(response)
+}
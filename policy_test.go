@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/willthames/otre/rules"
+)
+
+func TestReloadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := path.Join(dir, "policy.rego")
+	original := []byte("package otre\n\nresponse = {\"sampleRate\": 25, \"reason\": \"original\"}\n")
+	ioutil.WriteFile(policyFile, original, 0644)
+	re, err := rules.NewRulesEngine(string(original))
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	hashFile := func() string {
+		policy, err := rules.LoadPolicy(policyFile)
+		if err != nil {
+			t.Fatalf("Couldn't load policy: %v", err)
+		}
+		return policy.Hash()
+	}
+	originalHash := hashFile()
+	a := &app{policyFile: policyFile, re: re}
+	a.activatePolicy(originalHash, "")
+
+	ioutil.WriteFile(policyFile, []byte("package otre\n\nresponse = {"), 0644)
+	w := httptest.NewRecorder()
+	a.handleReload(w, httptest.NewRequest("POST", "/admin/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Reloading an invalid policy should fail, got %d", w.Code)
+	}
+	if a.policyHash != originalHash || testutil.ToFloat64(policyLastReloadSuccess) != 0 {
+		t.Errorf("Invalid policy should not replace the active policy")
+	}
+	errors := testutil.ToFloat64(policyReloads.WithLabelValues("watch", "error"))
+	for i := 0; i < 2; i++ {
+		if _, err := a.reloadPolicy("watch"); err == nil {
+			t.Errorf("Watching an invalid policy should fail")
+		}
+	}
+	if got := testutil.ToFloat64(policyReloads.WithLabelValues("watch", "error")) - errors; got != 0 {
+		t.Errorf("An unchanged invalid policy should only be reported once, got %v more errors", got)
+	}
+
+	reloaded := []byte("package otre\n\nresponse = {\"sampleRate\": 50, \"reason\": \"reloaded\"}\n")
+	ioutil.WriteFile(policyFile, reloaded, 0644)
+	hash, err := a.reloadPolicy("test")
+	if err != nil || hash != hashFile() {
+		t.Errorf("Valid policy should become the active policy (%v)", err)
+	}
+	if testutil.ToFloat64(policyInfo.WithLabelValues(hash, "")) != 1 || testutil.ToFloat64(policyLastReloadSuccess) != 1 {
+		t.Errorf("Policy metrics should report the reloaded policy")
+	}
+	if _, result := a.re.AcceptSpans(nil); result.Reason != "reloaded" {
+		t.Errorf("Rules engine should use the reloaded policy, reason: %v", result.Reason)
+	}
+}
+
+func TestPolicyBundleServer(t *testing.T) {
+	revision := "one"
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == revision {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", revision)
+		module := "package otre\n\nresponse = {\"sampleRate\": data.rate, \"reason\": \"bundle\"}\n"
+		if revision == "invalid" {
+			module = "package otre\n\nresponse = {\"reason\": \"no sample rate\"}\n"
+		}
+		bundle.Write(w, bundle.Bundle{
+			Manifest: bundle.Manifest{Revision: revision},
+			Data:     map[string]interface{}{"rate": 100},
+			Modules:  []bundle.ModuleFile{{Path: "otre.rego", Raw: []byte(module)}},
+		})
+	}))
+	defer server.Close()
+
+	a, destination := newTestApp(t, 0)
+	a.policyBundleURL = server.URL
+	if _, err := a.reloadPolicy("test"); err != nil {
+		t.Fatalf("Couldn't load policy from bundle server: %v", err)
+	}
+	if a.policyRevision != "one" || testutil.ToFloat64(policyInfo.WithLabelValues(a.policyHash, "one")) != 1 {
+		t.Errorf("Policy metrics should report the bundle revision")
+	}
+
+	notModified := testutil.ToFloat64(policyBundleFetches.WithLabelValues("not_modified"))
+	hash := a.policyHash
+	if _, err := a.reloadPolicy("test"); err != nil || a.policyHash != hash {
+		t.Errorf("Unchanged bundle should leave the policy active (%v)", err)
+	}
+	if requests != 2 || testutil.ToFloat64(policyBundleFetches.WithLabelValues("not_modified")) != notModified+1 {
+		t.Errorf("Unchanged bundle should be reported as not modified")
+	}
+
+	revision = "two"
+	if _, err := a.reloadPolicy("test"); err != nil || a.policyRevision != "two" {
+		t.Errorf("New bundle revision should become active (%v)", err)
+	}
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	if len(destination.payloads) != 1 {
+		t.Fatalf("Trace should be accepted by the bundle policy")
+	}
+	if tag := destination.payloads[0].Spans[0].BinaryAnnotations["PolicyRevision"]; tag != "two" {
+		t.Errorf("Sampled trace should be tagged with the policy revision, got %v", tag)
+	}
+
+	revision = "invalid"
+	for i := 0; i < 2; i++ {
+		if _, err := a.reloadPolicy("test"); err == nil || a.policyRevision != "two" {
+			t.Errorf("Invalid bundle should fail to load on every poll, leaving the last good revision active (%v)", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/willthames/otre/rules"
+)
+
+// policyFixture is a trace along with the decision the policy is
+// expected to make for it. Either part of the expected decision may
+// be left out to skip checking it
+type policyFixture struct {
+	Expected struct {
+		SampleRate *int    `json:"sampleRate"`
+		Reason     *string `json:"reason"`
+	} `json:"expected"`
+	Spans []types.Span `json:"spans"`
+}
+
+// checkFixture evaluates a fixture against the rules engine, returning
+// a description of any difference from the expected decision
+func checkFixture(re *rules.RulesEngine, fixture *policyFixture) string {
+	_, result := re.AcceptSpans(fixture.Spans)
+	expected := fixture.Expected
+	if expected.SampleRate != nil && *expected.SampleRate != result.SampleRate {
+		return fmt.Sprintf("expected sample rate %d, got %d (%s)", *expected.SampleRate, result.SampleRate, result.Reason)
+	}
+	if expected.Reason != nil && *expected.Reason != result.Reason {
+		return fmt.Sprintf("expected reason %q, got %q", *expected.Reason, result.Reason)
+	}
+	return ""
+}
+
+// runFixtures checks every .json fixture in dir against the rules
+// engine, printing the outcome of each, and returns the number that failed
+func runFixtures(re *rules.RulesEngine, dir string, w io.Writer) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no fixtures found in %s", dir)
+	}
+	sort.Strings(files)
+	failed := 0
+	for _, file := range files {
+		name := filepath.Base(file)
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return failed, err
+		}
+		fixture := new(policyFixture)
+		if err := json.Unmarshal(content, fixture); err != nil {
+			return failed, fmt.Errorf("%s: %v", name, err)
+		}
+		if failure := checkFixture(re, fixture); failure != "" {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", name, failure)
+		} else {
+			fmt.Fprintf(w, "PASS %s\n", name)
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(files)-failed, failed)
+	return failed, nil
+}
+
+// printTestReport prints the outcome of each Rego test and, if requested,
+// the coverage of each module. It returns the number of failed tests, plus
+// one if coverage is below the threshold
+func printTestReport(report *rules.TestReport, w io.Writer, coverage bool, threshold float64) int {
+	for _, result := range report.Results {
+		fmt.Fprintln(w, result.String())
+		if result.Error != nil {
+			fmt.Fprintf(w, "  %v\n", result.Error)
+		} else if result.FailedAt != nil {
+			fmt.Fprintf(w, "  failed at %v: %v\n", result.FailedAt.Location, result.FailedAt)
+		}
+	}
+	failed := report.Failed()
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(report.Results)-failed, failed)
+	if coverage {
+		files := make([]string, 0, len(report.Coverage.Files))
+		for file := range report.Coverage.Files {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			fmt.Fprintf(w, "coverage %s: %.2f%%\n", file, report.Coverage.Files[file].Coverage)
+		}
+		fmt.Fprintf(w, "coverage: %.2f%%\n", report.Coverage.Coverage)
+	}
+	if report.Coverage.Coverage < threshold {
+		fmt.Fprintf(w, "coverage %.2f%% is below threshold %.2f%%\n", report.Coverage.Coverage, threshold)
+		failed++
+	}
+	return failed
+}
+
+// testCommand runs the Rego tests in a policy and checks the policy
+// against a directory of trace fixtures, exiting non-zero if any test
+// or fixture fails
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	policyFile := flags.String("policy-file", "", "policy definition: a rego file, a directory of rego and data files, or an OPA bundle tarball")
+	policyInput := flags.String("policy-input", string(rules.DefaultInputFormat), "policy input format: structured, an object of the trace's spans, summary and span tree, or spans, the array of spans used by older policies")
+	fixtures := flags.String("fixtures", "", "directory of JSON trace fixtures with expected decisions")
+	coverage := flags.Bool("coverage", false, "report the coverage of the policy by its rego tests")
+	threshold := flags.Float64("coverage-threshold", 0, "minimum percentage coverage of the policy by its rego tests")
+	flags.Parse(args)
+
+	if *policyFile == "" {
+		fmt.Fprintln(os.Stderr, "--policy-file argument is mandatory")
+		flags.Usage()
+		return 2
+	}
+	inputFormat, err := rules.ParseInputFormat(*policyInput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	policy, err := rules.LoadPolicy(*policyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+		return 2
+	}
+	re, err := rules.NewInputRulesEngine(policy, inputFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+		return 2
+	}
+	report, err := rules.RunTests(context.Background(), policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running rego tests: %v\n", err)
+		return 2
+	}
+	if len(report.Results) == 0 && *fixtures == "" {
+		fmt.Fprintln(os.Stderr, "No rego tests found and no --fixtures given")
+		return 2
+	}
+	failed := 0
+	if len(report.Results) > 0 {
+		failed += printTestReport(report, os.Stdout, *coverage, *threshold)
+	}
+	if *fixtures != "" {
+		fixturesFailed, err := runFixtures(re, *fixtures, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error running fixtures: %v\n", err)
+			return 2
+		}
+		failed += fixturesFailed
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
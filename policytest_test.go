@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/willthames/otre/rules"
+)
+
+func TestRunFixtures(t *testing.T) {
+	policy, err := rules.LoadPolicy("rules/policy.rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := rules.NewPolicyRulesEngine(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if failed, err := runFixtures(re, "rules/fixtures", &out); err != nil || failed != 0 {
+		t.Errorf("Fixtures for the example policy should pass (%v):\n%s", err, out.String())
+	}
+
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "rate.json"), []byte(`{"expected": {"sampleRate": 50}, "spans": []}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "reason.json"), []byte(`{"expected": {"reason": "ping"}, "spans": []}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "pass.json"), []byte(`{"expected": {"sampleRate": 25, "reason": "fallback sample rate"}, "spans": []}`), 0644)
+	out.Reset()
+	failed, err := runFixtures(re, dir, &out)
+	if err != nil || failed != 2 {
+		t.Errorf("Expected 2 failing fixtures, got %d (%v):\n%s", failed, err, out.String())
+	}
+	if !strings.Contains(out.String(), "PASS pass.json") || !strings.Contains(out.String(), "FAIL rate.json") {
+		t.Errorf("Each fixture should be reported as passing or failing:\n%s", out.String())
+	}
+
+	if _, err := runFixtures(re, path.Join(dir, "missing"), &out); err == nil {
+		t.Errorf("Directory without fixtures should return an error")
+	}
+}
+
+// TestTestCommandDefaults runs the example policy and its fixtures with
+// otre test's default flags, so that the default policy input matches
+// the input the example policy expects
+func TestTestCommandDefaults(t *testing.T) {
+	if status := testCommand([]string{"--policy-file", "rules/policy.rego", "--fixtures", "rules/fixtures"}); status != 0 {
+		t.Errorf("Fixtures for the example policy should pass with the default flags, got exit status %d", status)
+	}
+}
+
+func TestPrintTestReport(t *testing.T) {
+	policy, err := rules.LoadPolicy("rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := rules.RunTests(context.Background(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if failed := printTestReport(report, &out, true, 0); failed != 0 {
+		t.Errorf("Rego tests for the example policy should pass:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "coverage: ") {
+		t.Errorf("Coverage should be reported when requested:\n%s", out.String())
+	}
+	out.Reset()
+	if failed := printTestReport(report, &out, false, 100); failed != 1 {
+		t.Errorf("Coverage below the threshold should count as a failure:\n%s", out.String())
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	v1 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v1"
+	v2 "github.com/honeycombio/honeycomb-opentracing-proxy/types/v2"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+// decodeSpans decodes a JSON array of spans in the given format: zipkin-v1,
+// zipkin-v2 or spans, the format otre sends spans to destinations in. The
+// capture format is an array of records written by otre's capture mode
+func decodeSpans(format string, data []byte) ([]types.Span, error) {
+	var decoded []*types.Span
+	var err error
+	switch format {
+	case "capture":
+		var records []captureRecord
+		err = json.Unmarshal(data, &records)
+		for _, record := range records {
+			for i := range record.Spans {
+				decoded = append(decoded, &record.Spans[i])
+			}
+		}
+	case "zipkin-v1":
+		decoded, err = v1.DecodeJSON(bytes.NewReader(data))
+	case "zipkin-v2":
+		decoded, err = v2.DecodeJSON(bytes.NewReader(data))
+	case "spans":
+		err = json.Unmarshal(data, &decoded)
+	default:
+		return nil, fmt.Errorf("invalid format %s, must be zipkin-v1, zipkin-v2, spans or capture", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	spans := make([]types.Span, 0, len(decoded))
+	for _, span := range decoded {
+		if span.BinaryAnnotations == nil {
+			span.BinaryAnnotations = map[string]interface{}{}
+		}
+		spans = append(spans, *span)
+	}
+	return spans, nil
+}
+
+// readSpans reads the spans in a file. Files ending .jsonl hold a span
+// or an array of spans per line, while any other file holds one array
+func readSpans(filename, format string) ([]types.Span, error) {
+	if !strings.HasSuffix(filename, ".jsonl") {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return decodeSpans(format, data)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var spans []types.Span
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if data[0] == '{' {
+			data = append(append([]byte("["), data...), ']')
+		}
+		decoded, err := decodeSpans(format, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, line, err)
+		}
+		spans = append(spans, decoded...)
+	}
+	return spans, scanner.Err()
+}
+
+// replayStats counts the traces and spans evaluated and accepted for
+// a single sample reason
+type replayStats struct {
+	SampleRate     int
+	Traces         int
+	Spans          int
+	AcceptedTraces int
+	AcceptedSpans  int
+}
+
+func (s *replayStats) add(other *replayStats) {
+	s.Traces += other.Traces
+	s.Spans += other.Spans
+	s.AcceptedTraces += other.AcceptedTraces
+	s.AcceptedSpans += other.AcceptedSpans
+}
+
+// replayTraces evaluates every trace in the buffer against the rules
+// engine in trace ID order, writing each accepted trace to output as a
+// line of JSON if output is not nil. It returns the statistics for each
+// sample reason
+func replayTraces(re *rules.RulesEngine, traceBuffer *traces.TraceBuffer, output io.Writer) (map[string]*replayStats, error) {
+	traceIDs := make([]string, 0, len(traceBuffer.Traces))
+	for traceID := range traceBuffer.Traces {
+		traceIDs = append(traceIDs, string(traceID))
+	}
+	sort.Strings(traceIDs)
+	stats := make(map[string]*replayStats)
+	for _, traceID := range traceIDs {
+		trace := traceBuffer.Traces[traces.TraceID(traceID)]
+		spans := trace.Spans()
+		decision, result := re.AcceptSpans(spans)
+		reasonStats, ok := stats[result.Reason]
+		if !ok {
+			reasonStats = &replayStats{SampleRate: result.SampleRate}
+			stats[result.Reason] = reasonStats
+		}
+		reasonStats.Traces++
+		reasonStats.Spans += len(spans)
+		if !decision {
+			continue
+		}
+		reasonStats.AcceptedTraces++
+		reasonStats.AcceptedSpans += len(spans)
+		if output == nil {
+			continue
+		}
+		trace.AddStringTag("SampleReason", result.Reason)
+		trace.AddIntTag("SampleRate", result.SampleRate)
+		data, err := trace.MarshalJSON()
+		if err != nil {
+			return stats, err
+		}
+		if _, err := output.Write(append(data, '\n')); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func percentage(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// printReplayStats prints the volume accepted for each sample reason,
+// followed by the totals
+func printReplayStats(stats map[string]*replayStats, w io.Writer) {
+	reasons := make([]string, 0, len(stats))
+	for reason := range stats {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REASON\tRATE\tTRACES\tSPANS\tACCEPTED TRACES\tACCEPTED SPANS\tREJECTED TRACES\tREJECTED SPANS")
+	total := new(replayStats)
+	for _, reason := range reasons {
+		s := stats[reason]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", reason, s.SampleRate, s.Traces, s.Spans,
+			s.AcceptedTraces, s.AcceptedSpans, s.Traces-s.AcceptedTraces, s.Spans-s.AcceptedSpans)
+		total.add(s)
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%d\t%d\t%d\t%d\t%d\t%d\n", total.Traces, total.Spans,
+		total.AcceptedTraces, total.AcceptedSpans, total.Traces-total.AcceptedTraces, total.Spans-total.AcceptedSpans)
+	tw.Flush()
+	fmt.Fprintf(w, "Accepted %.2f%% of traces and %.2f%% of spans\n",
+		percentage(total.AcceptedTraces, total.Traces), percentage(total.AcceptedSpans, total.Spans))
+}
+
+// replayCommand evaluates captured spans against a policy to show
+// how much volume the policy would keep
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: otre replay --policy-file POLICY [options] FILE...")
+		flags.PrintDefaults()
+	}
+	policyFile := flags.String("policy-file", "", "policy definition: a rego file, a directory of rego and data files, or an OPA bundle tarball")
+	policyInput := flags.String("policy-input", string(rules.DefaultInputFormat), "policy input format: structured, an object of the trace's spans, summary and span tree, or spans, the array of spans used by older policies")
+	format := flags.String("format", "zipkin-v2", "span format of the input files: zipkin-v1, zipkin-v2, spans or capture")
+	outputFile := flags.String("output", "", "file to write accepted traces to, one JSON array of spans per line")
+	flags.Parse(args)
+
+	if *policyFile == "" || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "--policy-file argument and at least one input file are mandatory")
+		flags.Usage()
+		return 2
+	}
+	inputFormat, err := rules.ParseInputFormat(*policyInput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	policy, err := rules.LoadPolicy(*policyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+		return 2
+	}
+	re, err := rules.NewInputRulesEngine(policy, inputFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading policy: %v\n", err)
+		return 2
+	}
+
+	traceBuffer := traces.NewTraceBuffer()
+	for _, filename := range flags.Args() {
+		spans, err := readSpans(filename, *format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", filename, err)
+			return 2
+		}
+		for _, span := range spans {
+			traceBuffer.AddSpan(span)
+		}
+	}
+
+	var output io.Writer
+	var f *os.File
+	var w *bufio.Writer
+	if *outputFile != "" {
+		f, err = os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			return 2
+		}
+		w = bufio.NewWriter(f)
+		output = w
+	}
+	stats, err := replayTraces(re, traceBuffer, output)
+	if err == nil && w != nil {
+		err = w.Flush()
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing accepted traces: %v\n", err)
+		return 2
+	}
+	printReplayStats(stats, os.Stdout)
+	return 0
+}
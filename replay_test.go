@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spansFile := path.Join(dir, "spans.jsonl")
+	ioutil.WriteFile(spansFile, []byte(`{"traceId": "a", "id": "a1", "name": "/ping", "serviceName": "web"}
+[{"traceId": "b", "id": "b1", "name": "/api", "serviceName": "web"}, {"traceId": "b", "id": "b2", "parentId": "b1", "name": "query", "serviceName": "db"}]
+
+{"traceId": "a", "id": "a2", "parentId": "a1", "name": "check", "serviceName": "web"}
+`), 0644)
+	zipkinFile := path.Join(dir, "zipkin.json")
+	ioutil.WriteFile(zipkinFile, []byte(`[{"traceId": "000000000000000c", "id": "000000000000000c", "name": "/ping", "localEndpoint": {"serviceName": "web"}, "timestamp": 1577504382812652}]`), 0644)
+
+	traceBuffer := traces.NewTraceBuffer()
+	spans, err := readSpans(spansFile, "spans")
+	if err != nil || len(spans) != 4 {
+		t.Fatalf("Expected 4 spans from JSONL file, got %d (%v)", len(spans), err)
+	}
+	zipkinSpans, err := readSpans(zipkinFile, "zipkin-v2")
+	if err != nil || len(zipkinSpans) != 1 {
+		t.Fatalf("Expected 1 span from zipkin file, got %d (%v)", len(zipkinSpans), err)
+	}
+	for _, span := range append(spans, zipkinSpans...) {
+		traceBuffer.AddSpan(span)
+	}
+	if _, err := readSpans(spansFile, "jaeger"); err == nil {
+		t.Errorf("Unknown format should return an error")
+	}
+
+	re, err := rules.NewRulesEngine(`package otre
+
+response = {"sampleRate": 0, "reason": "ping"} {
+  input.spans[_].name == "/ping"
+} else = {"sampleRate": 100, "reason": "default"} {
+  true
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	stats, err := replayTraces(re, traceBuffer, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping := stats["ping"]; ping == nil || ping.Traces != 2 || ping.Spans != 3 || ping.AcceptedTraces != 0 {
+		t.Errorf("Expected 2 rejected ping traces with 3 spans, got %+v", ping)
+	}
+	if accepted := stats["default"]; accepted == nil || accepted.AcceptedTraces != 1 || accepted.AcceptedSpans != 2 {
+		t.Errorf("Expected 1 accepted trace with 2 spans, got %+v", accepted)
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 1 || !strings.Contains(output.String(), `"SampleReason":"default"`) {
+		t.Errorf("Accepted trace should be written with its sample reason, got:\n%s", output.String())
+	}
+
+	var report bytes.Buffer
+	printReplayStats(stats, &report)
+	if !strings.Contains(report.String(), "Accepted 33.33% of traces and 40.00% of spans") {
+		t.Errorf("Report should include the proportion of volume accepted, got:\n%s", report.String())
+	}
+}
+
+func TestReplayCommandOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := path.Join(dir, "policy.rego")
+	ioutil.WriteFile(policyFile, []byte(`package otre
+
+response = {"sampleRate": 100, "reason": "all"}`), 0644)
+	spansFile := path.Join(dir, "spans.jsonl")
+	var spans strings.Builder
+	for _, traceID := range []string{"e", "b", "d", "a", "c"} {
+		fmt.Fprintf(&spans, `{"traceId": "%s", "id": "%s1", "name": "/api", "serviceName": "web"}`+"\n", traceID, traceID)
+	}
+	ioutil.WriteFile(spansFile, []byte(spans.String()), 0644)
+	outputFile := path.Join(dir, "accepted.jsonl")
+
+	if status := replayCommand([]string{"--policy-file", policyFile, "--format", "spans", "--output", outputFile, spansFile}); status != 0 {
+		t.Fatalf("Expected replay to succeed, got exit status %d", status)
+	}
+	content, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var traceIDs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var trace []types.Span
+		if err := json.Unmarshal([]byte(line), &trace); err != nil || len(trace) != 1 {
+			t.Fatalf("Expected a JSON array of one span per line, got %s (%v)", line, err)
+		}
+		traceIDs = append(traceIDs, trace[0].TraceID)
+	}
+	if strings.Join(traceIDs, ",") != "a,b,c,d,e" {
+		t.Errorf("Accepted traces should be written in trace ID order, got %v", traceIDs)
+	}
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to check write errors")
+	}
+	if status := replayCommand([]string{"--policy-file", policyFile, "--format", "spans", "--output", "/dev/full", spansFile}); status != 2 {
+		t.Errorf("Expected exit status 2 when accepted traces can't be written, got %d", status)
+	}
+}
@@ -0,0 +1,213 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	honey "github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/types"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/willthames/otre/summary"
+)
+
+// spansType is the type of an array of spans, such as input.spans
+var spansType = types.NewArray(nil, types.A)
+
+// builtin is an otre built-in function available to policies
+type builtin struct {
+	decl *ast.Builtin
+	impl topdown.BuiltinFunc
+}
+
+// builtins are the otre built-in functions available to policies.
+// otre.trace_duration(spans) is the time in ms from the start of the
+// earliest span to the finish of the latest. otre.spans_by_service(spans,
+// service) is the spans from a service, and otre.descendants(spans, id)
+// the spans below the span with that ID, depth first. otre.http_status(span)
+// is the span's HTTP status code as a number from Zipkin or OpenTelemetry
+// tags, undefined if it has none, and otre.url_template(url) is the path of
+// a URL with IDs replaced by {id}
+var builtins = []builtin{
+	builtin1("otre.trace_duration", spansType, types.N, func(operand interface{}) (interface{}, error) {
+		spans, err := decodeSpans(operand)
+		if err != nil {
+			return nil, err
+		}
+		return summary.DurationMs(spans), nil
+	}),
+	builtin2("otre.spans_by_service", spansType, types.S, spansType, func(operand1, operand2 interface{}) (interface{}, error) {
+		spans, err := decodeSpans(operand1)
+		if err != nil {
+			return nil, err
+		}
+		service, err := stringOperand(operand2, "service")
+		if err != nil {
+			return nil, err
+		}
+		result := []honey.Span{}
+		for _, span := range spans {
+			if span.ServiceName == service {
+				result = append(result, span)
+			}
+		}
+		return result, nil
+	}),
+	builtin2("otre.descendants", spansType, types.S, spansType, func(operand1, operand2 interface{}) (interface{}, error) {
+		spans, err := decodeSpans(operand1)
+		if err != nil {
+			return nil, err
+		}
+		id, err := stringOperand(operand2, "id")
+		if err != nil {
+			return nil, err
+		}
+		tree := summary.NewTree(spans)
+		result := []honey.Span{}
+		for _, id := range tree.Descendants(id) {
+			span, _ := tree.Span(id)
+			result = append(result, span)
+		}
+		return result, nil
+	}),
+	builtin1("otre.http_status", types.A, types.N, func(operand interface{}) (interface{}, error) {
+		var span honey.Span
+		if err := convert(operand, &span); err != nil {
+			return nil, err
+		}
+		if code, ok := summary.StatusCode(span); ok {
+			return code, nil
+		}
+		return nil, nil
+	}),
+	builtin1("otre.url_template", types.S, types.S, func(operand interface{}) (interface{}, error) {
+		rawURL, err := stringOperand(operand, "url")
+		if err != nil {
+			return nil, err
+		}
+		return urlTemplate(rawURL), nil
+	}),
+}
+
+var registerOnce sync.Once
+
+// registerBuiltins registers the otre built-in functions with OPA. They
+// are registered globally rather than with each query so that the Rego
+// tests run by RunTests can call them too
+func registerBuiltins() {
+	registerOnce.Do(func() {
+		for _, b := range builtins {
+			ast.RegisterBuiltin(b.decl)
+			topdown.RegisterBuiltinFunc(b.decl.Name, b.impl)
+		}
+	})
+}
+
+// builtin1 creates a built-in function of one argument from a function
+// of its JSON value. A nil result leaves the built-in function undefined
+func builtin1(name string, arg, result types.Type, f func(interface{}) (interface{}, error)) builtin {
+	return builtin{
+		decl: &ast.Builtin{Name: name, Decl: types.NewFunction(types.Args(arg), result)},
+		impl: func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			operand, err := ast.JSON(operands[0].Value)
+			if err != nil {
+				return finishBuiltin(name, bctx, nil, err, iter)
+			}
+			value, err := f(operand)
+			return finishBuiltin(name, bctx, value, err, iter)
+		},
+	}
+}
+
+// builtin2 creates a built-in function of two arguments from a function
+// of their JSON values
+func builtin2(name string, arg1, arg2, result types.Type, f func(interface{}, interface{}) (interface{}, error)) builtin {
+	return builtin{
+		decl: &ast.Builtin{Name: name, Decl: types.NewFunction(types.Args(arg1, arg2), result)},
+		impl: func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			operand1, err := ast.JSON(operands[0].Value)
+			if err != nil {
+				return finishBuiltin(name, bctx, nil, err, iter)
+			}
+			operand2, err := ast.JSON(operands[1].Value)
+			if err != nil {
+				return finishBuiltin(name, bctx, nil, err, iter)
+			}
+			value, err := f(operand1, operand2)
+			return finishBuiltin(name, bctx, value, err, iter)
+		},
+	}
+}
+
+// finishBuiltin passes the result of a built-in function to iter,
+// converting errors to evaluation errors
+func finishBuiltin(name string, bctx topdown.BuiltinContext, result interface{}, err error, iter func(*ast.Term) error) error {
+	if err == nil && result != nil {
+		var value ast.Value
+		if err = util.RoundTrip(&result); err == nil {
+			value, err = ast.InterfaceToValue(result)
+		}
+		if err == nil {
+			return iter(ast.NewTerm(value))
+		}
+	}
+	if err != nil {
+		return &topdown.Error{Code: topdown.BuiltinErr, Message: name + ": " + err.Error(), Location: bctx.Location}
+	}
+	return nil
+}
+
+// stringOperand returns an argument that must be a string. The type
+// checker can't rule out other types for values computed from input,
+// and OPA doesn't recover from a built-in function panicking
+func stringOperand(operand interface{}, name string) (string, error) {
+	s, ok := operand.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, not %v", name, operand)
+	}
+	return s, nil
+}
+
+// convert converts a JSON value to a Go value such as a span
+func convert(value interface{}, v interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeSpans converts a JSON array of spans to spans
+func decodeSpans(value interface{}) ([]honey.Span, error) {
+	var spans []honey.Span
+	err := convert(value, &spans)
+	return spans, err
+}
+
+var (
+	numberPattern = regexp.MustCompile(`^[0-9]+$`)
+	uuidPattern   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexPattern    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// urlTemplate returns the path of a URL, or of a path with an optional
+// query string, with each segment that is a number, a UUID, or 16 or
+// more hex digits replaced by {id}
+func urlTemplate(rawURL string) string {
+	path := strings.SplitN(rawURL, "?", 2)[0]
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.EscapedPath()
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if numberPattern.MatchString(segment) || uuidPattern.MatchString(segment) || hexPattern.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,276 @@
+package rules
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+// signaturesFile is the bundle file holding the signed hashes
+// of every other file in the bundle
+const signaturesFile = ".signatures.json"
+
+type bundleSignatures struct {
+	Signatures []string `json:"signatures"`
+}
+
+type signedFile struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+}
+
+type signaturePayload struct {
+	Files []signedFile `json:"files"`
+}
+
+// Verifier checks the signature of a bundle, signed as a JWT
+// using either an HS256 shared secret or an RS256 key pair
+type Verifier struct {
+	Algorithm string
+	key       interface{}
+}
+
+// NewVerifier creates a Verifier for the given algorithm. The key
+// is the shared secret for HS256 or a PEM encoded public key for RS256
+func NewVerifier(algorithm string, key []byte) (*Verifier, error) {
+	v := &Verifier{Algorithm: algorithm}
+	switch algorithm {
+	case "HS256":
+		v.key = key
+	case "RS256":
+		block, _ := pem.Decode(key)
+		if block == nil {
+			return nil, errors.New("RS256 key is not PEM encoded")
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("RS256 key is not an RSA public key")
+		}
+		v.key = rsaKey
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s, must be HS256 or RS256", algorithm)
+	}
+	return v, nil
+}
+
+// verifyToken checks the signature of a compact serialised JWT
+// and returns its payload
+func (v *Verifier) verifyToken(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("signature is not a JWT")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var h struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, err
+	}
+	if h.Algorithm != v.Algorithm {
+		return nil, fmt.Errorf("signature algorithm %s does not match %s", h.Algorithm, v.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := v.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+// fileHash returns the hex encoded sha256 hash of a bundle file. JSON
+// files are hashed in their compact form with sorted keys so that
+// formatting doesn't affect the hash
+func fileHash(name string, content []byte) (string, error) {
+	if path.Ext(name) == ".json" {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		content, _ = json.Marshal(value)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks that the bundle files are exactly those listed in
+// the bundle's signature, with matching hashes
+func (v *Verifier) Verify(files map[string][]byte) error {
+	content, ok := files[signaturesFile]
+	if !ok {
+		return errors.New("bundle is not signed")
+	}
+	var signatures bundleSignatures
+	if err := json.Unmarshal(content, &signatures); err != nil {
+		return err
+	}
+	if len(signatures.Signatures) != 1 {
+		return fmt.Errorf("bundle must have exactly one signature, found %d", len(signatures.Signatures))
+	}
+	token, err := v.verifyToken(signatures.Signatures[0])
+	if err != nil {
+		return err
+	}
+	var payload signaturePayload
+	if err := json.Unmarshal(token, &payload); err != nil {
+		return err
+	}
+	signed := make(map[string]bool, len(payload.Files))
+	for _, file := range payload.Files {
+		name := cleanBundlePath(file.Name)
+		content, ok := files[name]
+		if !ok {
+			return fmt.Errorf("signed file %s is missing from bundle", name)
+		}
+		if file.Algorithm != "SHA-256" {
+			return fmt.Errorf("unsupported hash algorithm %s for %s", file.Algorithm, name)
+		}
+		hash, err := fileHash(name, content)
+		if err != nil {
+			return err
+		}
+		if hash != file.Hash {
+			return fmt.Errorf("hash of %s does not match signature", name)
+		}
+		signed[name] = true
+	}
+	for name := range files {
+		if name != signaturesFile && !signed[name] {
+			return fmt.Errorf("bundle file %s is not signed", name)
+		}
+	}
+	return nil
+}
+
+func cleanBundlePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// tarballFiles returns the contents of every regular file in a gzipped
+// tarball, keyed by cleaned path. A path may only appear once, so that
+// the files verified are exactly the files loaded
+func tarballFiles(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		name := cleanBundlePath(header.Name)
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("bundle contains %s more than once", name)
+		}
+		files[name] = content
+	}
+}
+
+// writeTarball writes files to a gzipped tarball in path order
+func writeTarball(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadBundle reads a policy from an OPA bundle tarball. If verifier
+// is not nil, the bundle must be signed by the verifier's key. The
+// policy is built from the files as read for verification, rather
+// than by parsing the tarball a second time
+func ReadBundle(r io.Reader, verifier *Verifier) (*Policy, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	files, err := tarballFiles(data)
+	if err != nil {
+		return nil, err
+	}
+	if verifier != nil {
+		if err := verifier.Verify(files); err != nil {
+			return nil, fmt.Errorf("bundle verification failed: %v", err)
+		}
+	}
+	if data, err = writeTarball(files); err != nil {
+		return nil, err
+	}
+	b, err := bundle.NewReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, err
+	}
+	return bundlePolicy(b), nil
+}
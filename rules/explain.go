@@ -0,0 +1,68 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	honey "github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+)
+
+// Explanation is the result of evaluating spans against the policy,
+// along with OPA's trace of the evaluation. SatisfiedRules lists every
+// rule whose body was satisfied during evaluation, including helper
+// rules whose values did not end up determining the response
+type Explanation struct {
+	Result         *SampleResult `json:"result"`
+	Error          string        `json:"error,omitempty"`
+	SatisfiedRules []string      `json:"satisfiedRules"`
+	Explain        []string      `json:"explain"`
+}
+
+// Explain evaluates spans against the policy with tracing enabled. The
+// explain mode selects the trace events returned: full for every event,
+// notes for trace() calls only, or fails for failed expressions only
+func (r *RulesEngine) Explain(spans []honey.Span, mode string) (*Explanation, error) {
+	switch mode {
+	case "", "full", "notes", "fails":
+	default:
+		return nil, fmt.Errorf("invalid explain mode %s, must be full, notes or fails", mode)
+	}
+	tracer := topdown.NewBufferTracer()
+	result, err := r.evaluate(spans, tracer)
+	explanation := &Explanation{Result: result, SatisfiedRules: []string{}}
+	if err != nil {
+		explanation.Error = err.Error()
+	}
+
+	seen := make(map[string]bool)
+	for _, event := range *tracer {
+		rule, ok := event.Node.(*ast.Rule)
+		if event.Op != topdown.ExitOp || !ok {
+			continue
+		}
+		name := rule.Path().String()
+		if event.Location != nil {
+			name = fmt.Sprintf("%s (%s:%d)", name, event.Location.File, event.Location.Row)
+		}
+		if !seen[name] {
+			seen[name] = true
+			explanation.SatisfiedRules = append(explanation.SatisfiedRules, name)
+		}
+	}
+
+	events := []*topdown.Event(*tracer)
+	switch mode {
+	case "notes":
+		events = lineage.Notes(events)
+	case "fails":
+		events = lineage.Fails(events)
+	}
+	var buf bytes.Buffer
+	topdown.PrettyTrace(&buf, events)
+	explanation.Explain = strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	return explanation, nil
+}
@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/loader"
+)
+
+// Policy is a set of Rego modules, keyed by path, and the data
+// documents available to them under data.
+type Policy struct {
+	Modules  map[string]string
+	Data     map[string]interface{}
+	Revision string
+}
+
+// NewPolicy creates a policy from the source of a single Rego module
+func NewPolicy(module string) *Policy {
+	return &Policy{Modules: map[string]string{"accept.rego": module}, Data: map[string]interface{}{}}
+}
+
+// LoadPolicy loads a policy from a single Rego file, a directory or an
+// OPA bundle tarball, which is recognised by its .tar.gz suffix or gzip
+// header. Directories and bundles may contain any number of .rego files,
+// with data.json and data.yaml files loaded under data. at the path of
+// the directory containing them
+func LoadPolicy(path string) (*Policy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		module, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !isTarball(path, module) {
+			return &Policy{Modules: map[string]string{filepath.Base(path): string(module)}, Data: map[string]interface{}{}}, nil
+		}
+	}
+	b, err := loader.AsBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	return bundlePolicy(*b), nil
+}
+
+// isTarball returns whether a policy file is a gzipped bundle tarball
+func isTarball(path string, contents []byte) bool {
+	return strings.HasSuffix(path, ".tar.gz") || bytes.HasPrefix(contents, []byte{0x1f, 0x8b})
+}
+
+func bundlePolicy(b bundle.Bundle) *Policy {
+	policy := &Policy{
+		Modules:  make(map[string]string, len(b.Modules)),
+		Data:     b.Data,
+		Revision: b.Manifest.Revision,
+	}
+	for _, module := range b.Modules {
+		policy.Modules[module.Path] = string(module.Raw)
+	}
+	return policy
+}
+
+// Hash returns the sha256 hash of the policy's modules, data and revision
+func (p *Policy) Hash() string {
+	paths := make([]string, 0, len(p.Modules))
+	for path := range p.Modules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write([]byte(p.Modules[path]))
+		h.Write([]byte{0})
+	}
+	// map keys are sorted when marshalled, so equal data hashes equally
+	data, _ := json.Marshal(p.Data)
+	h.Write(data)
+	h.Write([]byte(p.Revision))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -4,20 +4,20 @@ default url = ""
 default status = 0
 
 ping[span] {
-  span := input[_]
-  url :=  input[_].binaryAnnotations["http.url"]
+  span := input.spans[_]
+  url :=  input.spans[_].binaryAnnotations["http.url"]
   endswith(url, "/ping")
 }
 
 api_new_service[span] {
-  span := input[_]
-  url :=  input[_].binaryAnnotations["http.url"]
+  span := input.spans[_]
+  url :=  input.spans[_].binaryAnnotations["http.url"]
   contains(url, "/api/newService")
 }
 
 error_response[span] {
-  span := input[_]
-  status := to_number(span.binaryAnnotations["http.status_code"])
+  span := input.spans[_]
+  status := otre.http_status(span)
   status >= 500
 }
 
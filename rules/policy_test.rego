@@ -30,13 +30,17 @@ trace_ping = [
 ]
 
 test_accept_with_5xx_error {
-    otre.accept with input as trace_5xx
+    otre.response.sampleRate == 100 with input as {"spans": trace_5xx}
 }
 
 test_accept_with_api_newservice {
-    otre.accept with input as trace_api_newservice
+    otre.response.sampleRate == 100 with input as {"spans": trace_api_newservice}
 }
 
 test_reject_with_ping {
-    not otre.accept with input as trace_ping
-}
\ No newline at end of file
+    otre.response.sampleRate == 0 with input as {"spans": trace_ping}
+}
+
+test_fallback_with_normal {
+    otre.response == {"sampleRate": 25, "reason": "fallback sample rate"} with input as {"spans": trace_normal}
+}
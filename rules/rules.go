@@ -3,17 +3,78 @@ package rules
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	honey "github.com/honeycombio/honeycomb-opentracing-proxy/types"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/willthames/otre/summary"
 )
 
-// RulesEngine is used to test traces against a policy
+var (
+	evaluationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otre_policy_evaluation_duration_seconds",
+		Help:    "The time taken to evaluate a trace against a policy",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"policy"})
+	evaluationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_policy_evaluation_errors_total",
+		Help: "The total number of policy evaluations that fell back to the fallback decision, by error type",
+	}, []string{"policy", "type"})
+)
+
+// DefaultFallback is the result used when a policy can't be evaluated,
+// unless the rules engine is configured with another Fallback
+var DefaultFallback = SampleResult{SampleRate: 100, Reason: "Unexpected response, default to accept"}
+
+// InputFormat is the form in which spans are passed to a policy
+type InputFormat string
+
+const (
+	// StructuredInput passes an object with the trace's spans, a
+	// summary of the trace and its span tree, as input.spans,
+	// input.summary and input.tree
+	StructuredInput InputFormat = "structured"
+	// SpansInput passes the array of the trace's spans as input, as
+	// expected by policies written before StructuredInput
+	SpansInput InputFormat = "spans"
+	// DefaultInputFormat is the input format used unless another
+	// is asked for
+	DefaultInputFormat = StructuredInput
+)
+
+// ParseInputFormat checks that an input format is structured or spans
+func ParseInputFormat(format string) (InputFormat, error) {
+	switch InputFormat(format) {
+	case StructuredInput, SpansInput:
+		return InputFormat(format), nil
+	}
+	return "", fmt.Errorf("invalid policy input format %s, must be structured or spans", format)
+}
+
+// RulesEngine is used to test traces against a policy. Name labels
+// the engine's metrics, evaluations taking longer than Timeout are
+// abandoned, and Fallback is returned for any evaluation that fails
 type RulesEngine struct {
-	query rego.PreparedEvalQuery
-	ctx   context.Context
+	Name     string
+	Timeout  time.Duration
+	Fallback SampleResult
+
+	inputFormat InputFormat
+	query       rego.PreparedEvalQuery
+	revision    string
+	hash        string
+	ctx         context.Context
+	sync.RWMutex
 }
 
 // SampleResult expresses the result from the policy of
@@ -21,58 +82,232 @@ type RulesEngine struct {
 type SampleResult struct {
 	SampleRate int    `json:"sampleRate"`
 	Reason     string `json:"reason"`
+	Revision   string `json:"revision,omitempty"`
+	// PolicyHash identifies the policy that produced the result when
+	// the policy has no revision
+	PolicyHash string `json:"-"`
+}
+
+// validationInputs are evaluated against every policy when it is
+// loaded to check that the policy produces a valid response
+var validationInputs = [][]honey.Span{
+	{},
+	{
+		{
+			CoreSpanMetadata: honey.CoreSpanMetadata{TraceID: "validation", ID: "root", Name: "/", ServiceName: "otre"},
+			BinaryAnnotations: map[string]interface{}{
+				"http.url":         "http://localhost/",
+				"http.status_code": 200,
+			},
+		},
+	},
 }
 
 // NewRulesEngine creates a rules engine with a policy
-// defined by the policy argument
-func NewRulesEngine(policy string) *RulesEngine {
+// defined by the policy argument. It returns an error if
+// the policy can't be compiled or doesn't return a valid response
+func NewRulesEngine(policy string) (*RulesEngine, error) {
+	return NewPolicyRulesEngine(NewPolicy(policy))
+}
+
+// NewPolicyRulesEngine creates a rules engine from a policy that
+// may contain many modules and data documents
+func NewPolicyRulesEngine(policy *Policy) (*RulesEngine, error) {
+	return NewInputRulesEngine(policy, DefaultInputFormat)
+}
+
+// NewInputRulesEngine creates a rules engine from a policy that
+// expects its input in the given format. The otre built-in functions
+// are registered for use by the policy
+func NewInputRulesEngine(policy *Policy, format InputFormat) (*RulesEngine, error) {
 	var err error
+	registerBuiltins()
 	r := new(RulesEngine)
+	r.Name = "active"
+	r.inputFormat = format
+	r.Fallback = DefaultFallback
 	r.ctx = context.Background()
-	r.query, err = rego.New(
+	r.query, err = r.prepare(policy)
+	if err != nil {
+		return nil, err
+	}
+	r.revision, r.hash = policy.Revision, policy.Hash()
+	return r, nil
+}
+
+// prepare compiles a policy and validates its response against
+// each of the validationInputs
+func (r *RulesEngine) prepare(policy *Policy) (rego.PreparedEvalQuery, error) {
+	options := []func(*rego.Rego){
 		rego.Query("response = data.otre.response"),
-		rego.Module("accept.rego", policy),
-	).PrepareForEval(r.ctx)
+		rego.Store(inmem.NewFromObject(policy.Data)),
+	}
+	for path, module := range policy.Modules {
+		options = append(options, rego.Module(path, module))
+	}
+	query, err := rego.New(options...).PrepareForEval(r.ctx)
 	if err != nil {
-		logrus.WithError(err).Error("Error creating rules engine")
+		return query, err
 	}
-	return r
+	for _, spans := range validationInputs {
+		results, err := query.Eval(r.ctx, rego.EvalInput(r.input(spans)))
+		if err != nil {
+			return query, err
+		}
+		if _, err = parseResults(results); err != nil {
+			return query, fmt.Errorf("invalid policy response for input %v: %v", spans, err)
+		}
+	}
+	return query, nil
 }
 
-func (r *RulesEngine) sampleSpans(spans []honey.Span) *SampleResult {
-	results, err := r.query.Eval(r.ctx, rego.EvalInput(spans))
-	defaultResult := &SampleResult{SampleRate: 100, Reason: "Unexpected response, default to accept"}
+// input returns the policy input for a trace's spans
+func (r *RulesEngine) input(spans []honey.Span) interface{} {
+	if r.inputFormat == SpansInput {
+		return spans
+	}
+	return summary.NewInput(spans)
+}
 
+// Reload replaces the policy used by the rules engine. If the new
+// policy can't be prepared, the existing policy remains in use
+func (r *RulesEngine) Reload(policy *Policy) error {
+	query, err := r.prepare(policy)
 	if err != nil {
-		logrus.WithError(err).WithField("spans", spans)
-		return defaultResult
-	} else if len(results) == 0 {
-		logrus.WithField("spans", spans).Warn("No results returned")
-		return defaultResult
+		return err
+	}
+	r.Lock()
+	r.query, r.revision, r.hash = query, policy.Revision, policy.Hash()
+	r.Unlock()
+	return nil
+}
+
+// Revision returns the revision of the policy in use
+func (r *RulesEngine) Revision() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.revision
+}
+
+// parseResults checks that the policy response has an integer sampleRate
+// between 0 and 100 and a string reason
+func parseResults(results rego.ResultSet) (*SampleResult, error) {
+	if len(results) == 0 {
+		return nil, errors.New("response is undefined")
 	}
 	response, ok := results[0].Bindings["response"].(map[string]interface{})
 	if !ok {
-		logrus.WithField("spans", spans).WithField("results", results).Warn("Unexpected result returned")
-		return defaultResult
+		return nil, errors.New("response is not an object")
+	}
+	number, ok := response["sampleRate"].(json.Number)
+	if !ok {
+		return nil, errors.New("sampleRate is not a number")
 	}
-	sampleRate, err := response["sampleRate"].(json.Number).Int64()
+	sampleRate, err := number.Int64()
 	if err != nil {
-		logrus.WithError(err).WithField("spans", spans).WithField("results", results).Warn("Unexpected result returned")
-		return defaultResult
+		return nil, fmt.Errorf("sampleRate %v is not an integer", number)
 	}
-	var reason string
-	reason, ok = response["reason"].(string)
+	if sampleRate < 0 || sampleRate > 100 {
+		return nil, fmt.Errorf("sampleRate %d is not between 0 and 100", sampleRate)
+	}
+	reason, ok := response["reason"].(string)
 	if !ok {
-		logrus.WithField("spans", spans).WithField("results", results).Warn("Unexpected result returned")
-		return defaultResult
+		return nil, errors.New("reason is not a string")
+	}
+	return &SampleResult{SampleRate: int(sampleRate), Reason: reason}, nil
+}
+
+// ParseFallback parses the fallback decision for failed evaluations:
+// accept, reject or a fixed sample rate between 0 and 100
+func ParseFallback(fallback string) (SampleResult, error) {
+	switch fallback {
+	case "accept":
+		return DefaultFallback, nil
+	case "reject":
+		return SampleResult{SampleRate: 0, Reason: "Unexpected response, default to reject"}, nil
 	}
-	return &SampleResult{SampleRate: int(sampleRate), Reason: reason}
+	rate, err := strconv.Atoi(fallback)
+	if err != nil || rate < 0 || rate > 100 {
+		return SampleResult{}, fmt.Errorf("invalid fallback %s, must be accept, reject or a sample rate between 0 and 100", fallback)
+	}
+	return SampleResult{SampleRate: rate, Reason: fmt.Sprintf("Unexpected response, default to %d%% sample rate", rate)}, nil
+}
+
+// evaluate evaluates spans against the policy, returning the fallback
+// result along with the error if evaluation fails. If tracer is not nil
+// the evaluation is traced and left out of the evaluation metrics
+func (r *RulesEngine) evaluate(spans []honey.Span, tracer topdown.Tracer) (*SampleResult, error) {
+	r.RLock()
+	query, revision, hash := r.query, r.revision, r.hash
+	r.RUnlock()
+	ctx := r.ctx
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	options := []rego.EvalOption{rego.EvalInput(r.input(spans))}
+	if tracer != nil {
+		options = append(options, rego.EvalTracer(tracer))
+	}
+	start := time.Now()
+	results, err := query.Eval(ctx, options...)
+	fallback := r.Fallback
+	fallback.Revision, fallback.PolicyHash = revision, hash
+
+	errorType := ""
+	if err != nil {
+		errorType = "eval"
+		if ctx.Err() == context.DeadlineExceeded {
+			errorType = "timeout"
+		}
+	}
+	result, parseErr := parseResults(results)
+	if err == nil && parseErr != nil {
+		err = fmt.Errorf("unexpected result returned: %v", parseErr)
+		errorType = "invalid_response"
+		if len(results) == 0 {
+			errorType = "undefined"
+		}
+	}
+	if tracer == nil {
+		evaluationDuration.WithLabelValues(r.Name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			evaluationErrors.WithLabelValues(r.Name, errorType).Inc()
+		}
+	}
+	if err != nil {
+		return &fallback, err
+	}
+	result.Revision, result.PolicyHash = revision, hash
+	return result, nil
+}
+
+func (r *RulesEngine) sampleSpans(spans []honey.Span) *SampleResult {
+	result, err := r.evaluate(spans, nil)
+	if err != nil {
+		logrus.WithError(err).WithField("spans", spans).Warn("Error evaluating policy")
+	}
+	return result
+}
+
+// Evaluate returns the policy's sample result for a set of spans
+// without making a sampling decision
+func (r *RulesEngine) Evaluate(spans []honey.Span) *SampleResult {
+	return r.sampleSpans(spans)
+}
+
+// Accept returns whether a trace is sampled given a random draw
+// between 0 and 99. Using the same draw for two results compares
+// their sample rates rather than the randomness of sampling
+func (s *SampleResult) Accept(draw int) bool {
+	return draw < s.SampleRate
 }
 
 // AcceptSpans checks whether a set of spans is accepted by the rules
 // engine or not
 func (r *RulesEngine) AcceptSpans(spans []honey.Span) (decision bool, sample *SampleResult) {
 	sample = r.sampleSpans(spans)
-	decision = (rand.Intn(100) < sample.SampleRate)
+	decision = sample.Accept(rand.Intn(100))
 	return
 }
@@ -1,50 +1,63 @@
 package rules
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path"
-	"runtime"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type testTrace struct {
 	spans    []types.Span
 	expected int
+	reason   string
 }
 
-func newTestTrace(traceFile string, expected int) *testTrace {
-	t := new(testTrace)
-	byteTraces, err := ioutil.ReadFile(traceFile)
-	t.spans = *new([]types.Span)
-	err = json.Unmarshal(byteTraces, &t.spans)
+// newTestTrace loads a trace and its expected decision from a fixture
+// in the fixtures directory, as used by otre test
+func newTestTrace(fixture string) *testTrace {
+	var content struct {
+		Expected SampleResult `json:"expected"`
+		Spans    []types.Span `json:"spans"`
+	}
+	byteTraces, err := ioutil.ReadFile(path.Join("fixtures", fixture))
+	if err == nil {
+		err = json.Unmarshal(byteTraces, &content)
+	}
 	if err != nil {
 		panic(err)
 	}
-	t.expected = expected
-	for _, span := range t.spans {
-		out, err := json.Marshal(span)
-		if err != nil {
-			logrus.WithField("out", out).Warn("newTestTrace")
-		}
-	}
-	return t
+	return &testTrace{spans: content.Spans, expected: content.Expected.SampleRate, reason: content.Expected.Reason}
 }
 
 func TestAcceptTrace(t *testing.T) {
-	_, filename, _, _ := runtime.Caller(0)
-	parentdir := path.Join(path.Dir(filename), "..")
-
 	testTraces := [5]testTrace{
-		*newTestTrace(path.Join(parentdir, "rules", "trace_5xx.json"), 100),
-		*newTestTrace(path.Join(parentdir, "rules", "trace_ping.json"), 0),
-		*newTestTrace(path.Join(parentdir, "rules", "trace_ping_5xx.json"), 0),
-		*newTestTrace(path.Join(parentdir, "rules", "trace_api_newservice.json"), 100),
-		*newTestTrace(path.Join(parentdir, "rules", "trace_normal.json"), 25),
+		*newTestTrace("5xx.json"),
+		*newTestTrace("ping.json"),
+		*newTestTrace("ping_5xx.json"),
+		*newTestTrace("api_newservice.json"),
+		*newTestTrace("normal.json"),
 	}
 
 	rules, err := ioutil.ReadFile("policy.rego")
@@ -52,11 +65,14 @@ func TestAcceptTrace(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	rulesengine := NewRulesEngine(string(rules))
+	rulesengine, err := NewRulesEngine(string(rules))
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
 	for _, trace := range testTraces {
 		sampleResult := rulesengine.sampleSpans(trace.spans)
-		if sampleResult.SampleRate != trace.expected {
-			t.Errorf("Result of acceptSpans for trace %v not as expected (%v), reason: %v", trace.spans, trace.expected, sampleResult.Reason)
+		if sampleResult.SampleRate != trace.expected || sampleResult.Reason != trace.reason {
+			t.Errorf("Result of acceptSpans for trace %v not as expected (%v, %v), got %v, reason: %v", trace.spans, trace.expected, trace.reason, sampleResult.SampleRate, sampleResult.Reason)
 		}
 	}
 	// Seed 1 has 25, the critical edge case, in the first 8 values
@@ -71,3 +87,460 @@ func TestAcceptTrace(t *testing.T) {
 		}
 	}
 }
+
+func TestReload(t *testing.T) {
+	rulesengine, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": 25, "reason": "original"}`)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	if err := rulesengine.Reload(NewPolicy("package otre\n\nresponse = {")); err == nil {
+		t.Errorf("Reloading an invalid policy should return an error")
+	}
+	if result := rulesengine.sampleSpans(nil); result.Reason != "original" {
+		t.Errorf("Invalid policy should not replace the existing policy, reason: %v", result.Reason)
+	}
+	err = rulesengine.Reload(NewPolicy(`package otre
+
+response = {"sampleRate": 50, "reason": "reloaded"}`))
+	if err != nil {
+		t.Errorf("Couldn't reload valid policy: %v", err)
+	}
+	if result := rulesengine.sampleSpans(nil); result.Reason != "reloaded" || result.SampleRate != 50 {
+		t.Errorf("Reloaded policy should be used, reason: %v", result.Reason)
+	}
+}
+
+func TestInputFormat(t *testing.T) {
+	trace := newTestTrace("normal.json")
+	structured, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": 100, "reason": sprintf("%d spans from %s", [input.summary.spanCount, input.summary.root.serviceName])} {
+  input.summary.durationMs > 5000
+  input.summary.complete
+} else = {"sampleRate": 0, "reason": "fast"} {
+  true
+}`)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	if result := structured.Evaluate(trace.spans); result.Reason != "4 spans from nginx-ingress" {
+		t.Errorf("Structured input should include the trace summary, reason: %v", result.Reason)
+	}
+
+	tree, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": 100, "reason": concat(",", path)} {
+  path := [span.name | id := input.tree.criticalPath[_]; span := input.spans[input.tree.nodes[id].index]]
+}`)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	if result := tree.Evaluate(trace.spans); result.Reason != "/sleep/5,/sleep/5,/sleep,docker-debug.sleep" {
+		t.Errorf("Structured input should include the critical path, reason: %v", result.Reason)
+	}
+
+	legacy, err := NewInputRulesEngine(NewPolicy(`package otre
+
+response = {"sampleRate": 100, "reason": sprintf("%d spans", [count(input)])}`), SpansInput)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	if result := legacy.Evaluate(trace.spans); result.Reason != "4 spans" {
+		t.Errorf("Spans input should be the array of spans, reason: %v", result.Reason)
+	}
+	if _, err := ParseInputFormat("array"); err == nil {
+		t.Errorf("Invalid input format should return an error")
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	for reason, policy := range map[string]string{
+		"doesn't compile":         "package otre\n\nresponse = {",
+		"has no response":         "package otre\n\nresult = {\"sampleRate\": 25, \"reason\": \"fallback\"}",
+		"has undefined response":  "package otre\n\nresponse = {\"sampleRate\": 25, \"reason\": \"one span\"} { count(input.spans) == 1 }",
+		"has non-integer rate":    "package otre\n\nresponse = {\"sampleRate\": 2.5, \"reason\": \"fallback\"}",
+		"has out of range rate":   "package otre\n\nresponse = {\"sampleRate\": 250, \"reason\": \"fallback\"}",
+		"has string rate":         "package otre\n\nresponse = {\"sampleRate\": \"25\", \"reason\": \"fallback\"}",
+		"has non-string reason":   "package otre\n\nresponse = {\"sampleRate\": 25, \"reason\": 1}",
+		"has non-object response": "package otre\n\nresponse = 25",
+	} {
+		if _, err := NewRulesEngine(policy); err == nil {
+			t.Errorf("Creating a rules engine with a policy that %s should return an error", reason)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := loader.AsBundle("../test/bundle")
+	if err != nil {
+		t.Fatalf("Couldn't read bundle directory: %v", err)
+	}
+	tarball := path.Join(dir, "bundle.tar.gz")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.Write(f, *b); err != nil {
+		t.Fatalf("Couldn't write bundle tarball: %v", err)
+	}
+	f.Close()
+	// a tarball without the .tar.gz suffix is recognised by its contents
+	unsuffixed := path.Join(dir, "bundle")
+	contents, _ := ioutil.ReadFile(tarball)
+	ioutil.WriteFile(unsuffixed, contents, 0644)
+
+	normal := newTestTrace("normal.json")
+	normal.expected = 50
+	ping := newTestTrace("ping.json")
+	for _, source := range []string{"../test/bundle", tarball, unsuffixed} {
+		policy, err := LoadPolicy(source)
+		if err != nil {
+			t.Fatalf("Couldn't load policy from %s: %v", source, err)
+		}
+		if len(policy.Modules) != 2 || policy.Revision != "test-revision" {
+			t.Errorf("Policy from %s should have two modules and a revision, got %d modules and revision %q", source, len(policy.Modules), policy.Revision)
+		}
+		rulesengine, err := NewPolicyRulesEngine(policy)
+		if err != nil {
+			t.Fatalf("Couldn't create rules engine from %s: %v", source, err)
+		}
+		for _, trace := range []*testTrace{normal, ping} {
+			if result := rulesengine.sampleSpans(trace.spans); result.SampleRate != trace.expected {
+				t.Errorf("Policy from %s should use shared modules and data, expected sample rate %d, got %d (%s)", source, trace.expected, result.SampleRate, result.Reason)
+			}
+		}
+	}
+
+	single, err := LoadPolicy("policy.rego")
+	if err != nil || len(single.Modules) != 1 {
+		t.Errorf("A single rego file should load as one module: %v", err)
+	}
+	if single.Hash() == NewPolicy("").Hash() {
+		t.Errorf("Different policies should have different hashes")
+	}
+	module, _ := ioutil.ReadFile("policy.rego")
+	policyFile := path.Join(dir, "policy.txt")
+	ioutil.WriteFile(policyFile, module, 0644)
+	if other, err := LoadPolicy(policyFile); err != nil || len(other.Modules) != 1 {
+		t.Errorf("A policy file with another extension should load as one module: %v", err)
+	}
+}
+
+func writeTestTarball(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+// signTestBundle adds a .signatures.json file signing every other file
+func signTestBundle(t *testing.T, files map[string][]byte, algorithm string, sign func([]byte) []byte) {
+	var payload signaturePayload
+	for name, content := range files {
+		hash, err := fileHash(name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload.Files = append(payload.Files, signedFile{Name: name, Hash: hash, Algorithm: "SHA-256"})
+	}
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+	claims, _ := json.Marshal(payload)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	token := input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+	files[signaturesFile], _ = json.Marshal(bundleSignatures{Signatures: []string{token}})
+}
+
+func TestReadBundle(t *testing.T) {
+	testFiles := func() map[string][]byte {
+		return map[string][]byte{
+			"otre.rego": []byte("package otre\n\nresponse = {\"sampleRate\": data.rate, \"reason\": \"bundle\"}\n"),
+			"data.json": []byte("{\"rate\": 10}"),
+			".manifest": []byte("{\"revision\": \"signed\"}"),
+		}
+	}
+
+	secret := []byte("secret")
+	hs256, err := NewVerifier("HS256", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacSign := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	rs256, err := NewVerifier("RS256", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSign := func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, _ := rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA256, digest[:])
+		return signature
+	}
+
+	unsigned := testFiles()
+	if _, err := ReadBundle(bytes.NewReader(writeTestTarball(t, unsigned)), hs256); err == nil {
+		t.Errorf("Unsigned bundle should fail verification")
+	}
+	policy, err := ReadBundle(bytes.NewReader(writeTestTarball(t, unsigned)), nil)
+	if err != nil || policy.Revision != "signed" {
+		t.Errorf("Unsigned bundle should be read without a verifier: %v", err)
+	}
+
+	for algorithm, verifier := range map[string]*Verifier{"HS256": hs256, "RS256": rs256} {
+		sign := hmacSign
+		if algorithm == "RS256" {
+			sign = rsaSign
+		}
+		files := testFiles()
+		signTestBundle(t, files, algorithm, sign)
+		policy, err := ReadBundle(bytes.NewReader(writeTestTarball(t, files)), verifier)
+		if err != nil {
+			t.Fatalf("Bundle signed with %s should pass verification: %v", algorithm, err)
+		}
+		rulesengine, err := NewPolicyRulesEngine(policy)
+		if err != nil {
+			t.Fatalf("Couldn't create rules engine from signed bundle: %v", err)
+		}
+		if result := rulesengine.sampleSpans(nil); result.SampleRate != 10 || result.Revision != "signed" {
+			t.Errorf("Result should use bundle data and report the bundle revision, got %v", result)
+		}
+
+		files["data.json"] = []byte("{\"rate\": 100}")
+		if _, err := ReadBundle(bytes.NewReader(writeTestTarball(t, files)), verifier); err == nil {
+			t.Errorf("Bundle with modified file should fail %s verification", algorithm)
+		}
+		files = testFiles()
+		signTestBundle(t, files, algorithm, sign)
+		files["extra.rego"] = []byte("package extra\n")
+		if _, err := ReadBundle(bytes.NewReader(writeTestTarball(t, files)), verifier); err == nil {
+			t.Errorf("Bundle with unsigned file should fail %s verification", algorithm)
+		}
+	}
+
+	files := testFiles()
+	signTestBundle(t, files, "HS256", func(input []byte) []byte {
+		mac := hmac.New(sha256.New, []byte("wrong"))
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+	if _, err := ReadBundle(bytes.NewReader(writeTestTarball(t, files)), hs256); err == nil {
+		t.Errorf("Bundle signed with the wrong key should fail verification")
+	}
+}
+
+func TestReadBundleDuplicatePaths(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, file := range []struct{ name, content string }{
+		{"otre.rego", "package otre\n\nresponse = {\"sampleRate\": 10, \"reason\": \"signed\"}\n"},
+		{"./otre.rego", "package otre\n\nresponse = {\"sampleRate\": 100, \"reason\": \"unsigned\"}\n"},
+	} {
+		tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(file.content))
+	}
+	tw.Close()
+	gw.Close()
+	if _, err := ReadBundle(&buf, nil); err == nil {
+		t.Errorf("Bundle with the same path twice should fail to load")
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	policy, err := LoadPolicy(".")
+	if err != nil {
+		t.Fatalf("Couldn't load policy directory: %v", err)
+	}
+	report, err := RunTests(context.Background(), policy)
+	if err != nil {
+		t.Fatalf("Couldn't run rego tests: %v", err)
+	}
+	if len(report.Results) != 4 || report.Failed() != 0 {
+		t.Errorf("Expected 4 passing rego tests, got %d with %d failures", len(report.Results), report.Failed())
+	}
+	if report.Coverage.Coverage == 0 {
+		t.Errorf("Rego tests should report coverage of the policy")
+	}
+
+	policy = NewPolicy(`package otre
+
+response = {"sampleRate": 25, "reason": "fallback"}
+
+test_rate {
+  response.sampleRate == 50
+}`)
+	report, err = RunTests(context.Background(), policy)
+	if err != nil || report.Failed() != 1 {
+		t.Errorf("Failing rego test should be reported (%v)", err)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	trace := newTestTrace("5xx.json")
+	rulesengine, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": 100, "reason": reason} {
+  statuses := {status | status := otre.http_status(input.spans[_])}
+  descendants := otre.descendants(input.spans, "7800b113b233ee63")
+  below := [span.name | span := descendants[_]]
+  reason := sprintf("%d %d %v %v %s", [
+    round(otre.trace_duration(input.spans)),
+    count(otre.spans_by_service(input.spans, "docker-debug")),
+    statuses,
+    below,
+    otre.url_template("http://localhost/api/users/123/orders/9b2c5f4e-5d1a-4f1e-8a7b-1c2d3e4f5a6b?page=2")
+  ])
+}`)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	expected := `6887 3 {500} ["docker-debug.sleep", "/sleep"] /api/users/{id}/orders/{id}`
+	if result := rulesengine.Evaluate(trace.spans); result.Reason != expected {
+		t.Errorf("Expected built-in results %s, got %s", expected, result.Reason)
+	}
+
+	for url, template := range map[string]string{
+		"/ping": "/ping",
+		"/traces/463ac35c9f6413ad48485a3953bb6124": "/traces/{id}",
+		"/users/42/profile?tab=1":                  "/users/{id}/profile",
+		"https://example.com/v2/items/abc":         "/v2/items/abc",
+	} {
+		if result := urlTemplate(url); result != template {
+			t.Errorf("Expected template %s for %s, got %s", template, url, result)
+		}
+	}
+
+	// arguments computed from input can have any type, and must make
+	// evaluation fail rather than panic
+	for _, call := range []string{
+		"otre.trace_duration(arg)",
+		"otre.spans_by_service(input.spans, arg)",
+		"otre.descendants(input.spans, arg)",
+		"otre.http_status(arg)",
+		"otre.url_template(arg)",
+	} {
+		rulesengine, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": 100, "reason": sprintf("%v", [result])} {
+  arg := input.spans[_].binaryAnnotations.sleep
+  result := ` + call + `
+} else = {"sampleRate": 25, "reason": "no sleep"} {
+  true
+}`)
+		if err != nil {
+			t.Fatalf("Couldn't create rules engine calling %s: %v", call, err)
+		}
+		if _, err := rulesengine.evaluate(trace.spans, nil); err == nil {
+			t.Errorf("Calling %s with a number should fail", call)
+		}
+	}
+
+	policy := NewPolicy(`package otre
+
+response = {"sampleRate": 25, "reason": "fallback"}
+
+test_http_status {
+  otre.http_status({"binaryAnnotations": {"http.response.status_code": "404"}}) == 404
+  not otre.http_status({"binaryAnnotations": {}})
+}`)
+	report, err := RunTests(context.Background(), policy)
+	if err != nil || report.Failed() != 0 {
+		t.Errorf("Rego tests should be able to call built-ins (%v)", err)
+	}
+}
+
+func TestEvaluationFallback(t *testing.T) {
+	if _, err := ParseFallback("sometimes"); err == nil {
+		t.Errorf("Invalid fallback should return an error")
+	}
+	fallback, err := ParseFallback("10")
+	if err != nil || fallback.SampleRate != 10 {
+		t.Errorf("Fixed rate fallback should be parsed, got %v (%v)", fallback, err)
+	}
+
+	rulesengine, err := NewRulesEngine(`package otre
+
+response = {"sampleRate": count(pairs) % 100, "reason": "slow"} {
+  input.spans[_].name == "slow"
+  items := input.spans[_].binaryAnnotations.items
+  pairs := [1 | items[_]; items[_]]
+} else = {"sampleRate": to_number(input.spans[_].name), "reason": "error"} {
+  input.spans[_].name == "error"
+} else = {"sampleRate": 25, "reason": "fallback sample rate"} {
+  true
+}`)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	rulesengine.Timeout = time.Millisecond
+	rulesengine.Fallback, _ = ParseFallback("reject")
+
+	items := make([]interface{}, 3000)
+	for i := range items {
+		items[i] = i
+	}
+	for errorType, name := range map[string]string{"timeout": "slow", "eval": "error"} {
+		errors := testutil.ToFloat64(evaluationErrors.WithLabelValues("active", errorType))
+		span := types.Span{CoreSpanMetadata: types.CoreSpanMetadata{Name: name}, BinaryAnnotations: map[string]interface{}{}}
+		if name == "slow" {
+			span.BinaryAnnotations["items"] = items
+		}
+		result := rulesengine.sampleSpans([]types.Span{span})
+		if result.SampleRate != 0 || result.Reason != rulesengine.Fallback.Reason {
+			t.Errorf("Failed evaluation (%s) should return the fallback, got %v", errorType, result)
+		}
+		if testutil.ToFloat64(evaluationErrors.WithLabelValues("active", errorType)) != errors+1 {
+			t.Errorf("Failed evaluation should be counted with type %s", errorType)
+		}
+	}
+	if result := rulesengine.sampleSpans(nil); result.SampleRate != 25 {
+		t.Errorf("Evaluation within the timeout should use the policy, got %v", result)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	policy, err := LoadPolicy("policy.rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rulesengine, err := NewPolicyRulesEngine(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := newTestTrace("ping.json")
+	explanation, err := rulesengine.Explain(trace.spans, "fails")
+	if err != nil {
+		t.Fatalf("Couldn't explain trace: %v", err)
+	}
+	if explanation.Result.SampleRate != 0 {
+		t.Errorf("Explanation should include the sample result, got %v", explanation.Result)
+	}
+	satisfied := strings.Join(explanation.SatisfiedRules, "\n")
+	if !strings.Contains(satisfied, "data.otre.ping") || !strings.Contains(satisfied, "data.otre.response") {
+		t.Errorf("Explanation should include the satisfied ping and response rules, got:\n%s", satisfied)
+	}
+	if _, err := rulesengine.Explain(trace.spans, "everything"); err == nil {
+		t.Errorf("Invalid explain mode should return an error")
+	}
+}
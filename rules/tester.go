@@ -0,0 +1,57 @@
+package rules
+
+import (
+	"context"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/cover"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/tester"
+)
+
+// TestReport holds the outcome of each Rego test in a policy
+// and the coverage of the policy's modules by those tests
+type TestReport struct {
+	Results  []*tester.Result
+	Coverage cover.Report
+}
+
+// Failed returns the number of tests that failed or errored
+func (r *TestReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if !result.Pass() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// RunTests discovers and runs the test_ rules in a policy's modules
+// using OPA's test runner, with the policy's data documents available
+func RunTests(ctx context.Context, policy *Policy) (*TestReport, error) {
+	registerBuiltins()
+	modules := make(map[string]*ast.Module, len(policy.Modules))
+	for path, module := range policy.Modules {
+		parsed, err := ast.ParseModule(path, module)
+		if err != nil {
+			return nil, err
+		}
+		modules[path] = parsed
+	}
+	coverage := cover.New()
+	ch, err := tester.NewRunner().
+		SetStore(inmem.NewFromObject(policy.Data)).
+		SetCoverageTracer(coverage).
+		EnableFailureLine(true).
+		Run(ctx, modules)
+	if err != nil {
+		return nil, err
+	}
+	report := new(TestReport)
+	for result := range ch {
+		report.Results = append(report.Results, result)
+	}
+	report.Coverage = coverage.Report(modules)
+	return report, nil
+}
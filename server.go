@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
@@ -22,6 +24,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/willthames/otre/decisionlog"
 	"github.com/willthames/otre/rules"
 	"github.com/willthames/otre/traces"
 )
@@ -32,6 +35,8 @@ const (
 	requestIDKey key = 0
 )
 
+const abandonReason = "trace is older than abandonAge"
+
 var (
 	incompleteTraces = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "otre_traces_incomplete_total",
@@ -116,6 +121,9 @@ func (a *app) handleSpans(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusAccepted)
+	if a.capture != nil {
+		a.capture.Record(r.URL.Path, contentType, spans)
+	}
 	var tbm traces.TraceBufferMetrics
 	for _, span := range spans {
 		logrus.WithField("spanID", span.ID).Debug("Adding span to tracebuffer")
@@ -126,6 +134,26 @@ func (a *app) handleSpans(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleReady handles the /ready endpoint. It reports the circuit breaker
+// state of each destination, responding with 503 while any circuit is open
+// so that spans are not routed to an otre that cannot deliver them
+func (a *app) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	circuits := make(map[string]string)
+	for _, destination := range a.destinations {
+		circuit := destination.Circuit()
+		circuits[circuit.Name] = circuit.State()
+		if circuit.Open() {
+			ready = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(circuits)
+}
+
 // ungzipWrap wraps a handleFunc and transparently ungzips the body of the
 // request if it is gzipped
 func ungzipWrap(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -165,8 +193,9 @@ func (a *app) start() error {
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/spans", ungzipWrap(a.handleSpans))
-	mux.HandleFunc("/api/v2/spans", ungzipWrap(a.handleSpans))
+	mux.HandleFunc("/api/v1/spans", a.mirrorWrap(ungzipWrap(a.handleSpans)))
+	mux.HandleFunc("/api/v2/spans", a.mirrorWrap(ungzipWrap(a.handleSpans)))
+	mux.HandleFunc("/ready", a.handleReady)
 	mux.HandleFunc("/", http.NotFoundHandler().ServeHTTP)
 
 	a.server = &http.Server{
@@ -179,8 +208,13 @@ func (a *app) start() error {
 		fmt.Println(line)
 	}
 	logrus.WithField("port", a.port).Info("Listening")
+	a.done = make(chan struct{})
 	ticker := time.NewTicker(a.flushAge)
 	go a.scheduler(ticker)
+	go a.reloadOnHangup()
+	if a.policyWatchInterval > 0 {
+		go a.watchPolicy(a.policyWatchInterval)
+	}
 	return nil
 }
 
@@ -199,9 +233,8 @@ func logging(logger *log.Logger) func(http.Handler) http.Handler {
 	}
 }
 
-func (a *app) stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+func (a *app) stop(ctx context.Context) error {
+	close(a.done)
 	return a.server.Shutdown(ctx)
 }
 
@@ -210,6 +243,9 @@ func (a *app) scheduler(tick *time.Ticker) {
 		select {
 		case <-tick.C:
 			a.processSpans()
+		case <-a.done:
+			tick.Stop()
+			return
 		}
 	}
 }
@@ -220,90 +256,156 @@ func (a *app) writeTrace(trace *traces.Trace) error {
 		logrus.WithError(err).WithField("trace", trace).Error("Error converting trace to JSON")
 		return err
 	}
-	if a.forwarder != nil {
-		if err := a.forwarder.Send(payload{ContentType: "application/json", Body: body}); err != nil {
+	if len(a.destinations) == 0 {
+		logrus.WithField("trace", trace).Info("dry-run: would have accepted trace")
+		return nil
+	}
+	p := payload{ContentType: "application/json", Body: body, TraceID: string(trace.ID()), Spans: trace.Spans()}
+	if _, result := trace.Sample(); result != nil {
+		p.SampleRate = result.SampleRate
+	}
+	var result error
+	for _, destination := range a.destinations {
+		err := destination.Send(p)
+		if err == errTraceTooLarge {
+			logrus.WithField("traceID", p.TraceID).WithField("spans", len(p.Spans)).Error("Trace is too large to forward, dropping it")
+			continue
+		}
+		if err != nil {
 			logrus.WithError(err).Error("Error forwarding trace")
 			logrus.WithField("body", body).Debug("Error forwarding trace body")
-			return err
+			result = err
 		}
+	}
+	if result == nil {
 		logrus.WithField("trace", trace).Debug("accepting trace")
-	} else {
-		logrus.WithField("trace", trace).Info("dry-run: would have accepted trace")
 	}
-	return nil
+	return result
 }
 
-func (a *app) processSpans() {
-	var traceID traces.TraceID
-	var trace *traces.Trace
+// sendTrace writes an accepted trace to the destinations, returning
+// whether it was sent and can be removed from the buffer
+func (a *app) sendTrace(trace *traces.Trace, counter prometheus.Counter) bool {
+	if err := a.writeTrace(trace); err != nil {
+		return false
+	}
+	counter.Inc()
+	return true
+}
+
+// acceptTrace tags a trace with the reason it was accepted and sends it
+func (a *app) acceptTrace(trace *traces.Trace, result *rules.SampleResult, counter prometheus.Counter) bool {
+	trace.SetSample(true, result)
+	a.recordDecision(trace, true, result.Reason)
+	trace.AddStringTag("SampleReason", result.Reason)
+	trace.AddIntTag("SampleRate", result.SampleRate)
+	if result.Revision != "" {
+		trace.AddStringTag("PolicyRevision", result.Revision)
+	}
+	return a.sendTrace(trace, counter)
+}
+
+// evaluateTrace checks a trace against the policy, sending it if accepted
+func (a *app) evaluateTrace(trace *traces.Trace) bool {
+	spans := trace.Spans()
+	draw := rand.Intn(100)
+	start := time.Now()
+	result := a.re.Evaluate(spans)
+	latency := time.Since(start)
+	decision := result.Accept(draw)
+	var shadow *decisionlog.ShadowDecision
+	if a.shadow != nil {
+		shadow = a.evaluateShadow(spans, draw, decision, result)
+	}
+	a.logDecision(trace, spans, decision, result, latency, shadow)
+	if decision {
+		return a.acceptTrace(trace, result, acceptedTraces)
+	}
+	trace.SetSample(decision, result)
+	a.recordDecision(trace, false, result.Reason)
+	logrus.WithField("trace", trace).Debug("dropping trace")
+	rejectedTraces.Inc()
+	return true
+}
+
+// acceptedCounter returns the counter for a trace that has been accepted
+func acceptedCounter(trace *traces.Trace) prometheus.Counter {
+	if _, result := trace.Sample(); strings.HasPrefix(result.Reason, abandonReason) {
+		return incompleteTraces
+	}
+	return acceptedTraces
+}
+
+// resendTrace retries sending a trace that was accepted but couldn't be
+// sent, giving up once the trace is older than flushTimeout
+func (a *app) resendTrace(trace *traces.Trace, now time.Time) bool {
+	if a.sendTrace(trace, acceptedCounter(trace)) {
+		return true
+	}
+	if trace.OlderThanRelative(a.flushTimeout, now) {
+		logrus.WithField("flushTimeout", a.flushTimeout).Warn("Couldn't write trace to collector within timeout")
+		logrus.WithField("trace", trace).Debug("Timed out trace")
+		timedOutTraces.Inc()
+		return true
+	}
+	return false
+}
+
+// decideTrace makes a sampling decision on a trace once it is complete
+// and older than flushAge, or older than abandonAge even if incomplete.
+// It returns whether the trace can be removed from the buffer
+func (a *app) decideTrace(trace *traces.Trace, now time.Time) bool {
+	_, result := trace.Sample()
+	switch {
+	case result != nil:
+		return a.resendTrace(trace, now)
+	case trace.IsComplete() && trace.OlderThanRelative(a.flushAge, now):
+		return a.evaluateTrace(trace)
+	case trace.OlderThanRelative(a.abandonAge, now):
+		result := &rules.SampleResult{SampleRate: 100, Reason: fmt.Sprintf("%s %dms", abandonReason, a.abandonAge/time.Millisecond)}
+		a.logOverride(trace, true, result)
+		return a.acceptTrace(trace, result, incompleteTraces)
+	}
+	return false
+}
+
+// processTraces calls decide for every trace in the buffer, removing
+// those traces for which it returns true
+func (a *app) processTraces(decide func(*traces.Trace, time.Time) bool) {
+	a.processLock.Lock()
+	defer a.processLock.Unlock()
 
 	logrus.Debug("processSpans: RLocking tracebuffer")
 	deletions := []traces.TraceID{}
 	now := time.Now()
 	a.traceBuffer.RLock()
-	for traceID, trace = range a.traceBuffer.Traces {
-
-		if trace.IsComplete() && trace.OlderThanRelative(a.flushAge, now) {
-			if trace.SampleResult != nil {
-				if trace.SampleDecision {
-					err := a.writeTrace(trace)
-					if err != nil {
-						deletions = append(deletions, traceID)
-						if strings.HasPrefix(trace.SampleResult.Reason, "trace is older than abandonAge") {
-							incompleteTraces.Inc()
-						} else {
-							acceptedTraces.Inc()
-						}
-					} else if trace.OlderThanRelative(a.flushTimeout, now) {
-						deletions = append(deletions, traceID)
-						logrus.WithField("flushTimeout", a.flushTimeout).Warn("Couldn't write trace to collector within timeout")
-						logrus.WithField("trace", trace).Debug("Timed out trace")
-						timedOutTraces.Inc()
-					}
-				}
-			}
-			trace.SampleDecision, trace.SampleResult = a.re.AcceptSpans(trace.Spans())
-			if trace.SampleDecision {
-				trace.AddStringTag("SampleReason", trace.SampleResult.Reason)
-				trace.AddIntTag("SampleRate", trace.SampleResult.SampleRate)
-				err := a.writeTrace(trace)
-				if err != nil {
-					deletions = append(deletions, traceID)
-					acceptedTraces.Inc()
-				}
-			} else {
-				logrus.WithField("trace", trace).Debug("dropping trace")
-				deletions = append(deletions, traceID)
-				rejectedTraces.Inc()
-			}
-		} else if trace.OlderThanRelative(a.abandonAge, now) {
-			reason := fmt.Sprintf("trace is older than abandonAge %dms", a.abandonAge)
-			trace.AddStringTag("SampleReason", reason)
-			trace.SampleResult = &rules.SampleResult{SampleRate: 100, Reason: reason}
-			trace.SampleDecision = true
-			err := a.writeTrace(trace)
-			if err != nil {
-				deletions = append(deletions, traceID)
-				incompleteTraces.Inc()
-			}
+	for traceID, trace := range a.traceBuffer.Traces {
+		if decide(trace, now) {
+			deletions = append(deletions, traceID)
 		}
 	}
 	logrus.Debug("processSpans: RUnlocking tracebuffer")
 
 	a.traceBuffer.RUnlock()
-	logrus.Debug("processSpans: Locking tracebuffer")
-	a.traceBuffer.Lock()
+	// DeleteTrace takes the tracebuffer lock itself
 	var tbm traces.TraceBufferMetrics
-	for _, traceID = range deletions {
+	for _, traceID := range deletions {
 		tbm = a.traceBuffer.DeleteTrace(traceID)
 		spansInBuffer.Add(float64(tbm.SpanDelta))
 		tracesInBuffer.Add(float64(tbm.TraceDelta))
 	}
-	logrus.Debug("processSpans: Unlocking tracebuffer")
-	a.traceBuffer.Unlock()
+}
+
+func (a *app) processSpans() {
+	a.processTraces(a.decideTrace)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
 	prometheus.Register(incompleteTraces)
 	prometheus.Register(acceptedTraces)
 	prometheus.Register(rejectedTraces)
@@ -321,15 +423,58 @@ func main() {
 	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 	if a.collectorURL != "" {
 		logrus.WithField("collectorURL", a.collectorURL).Debug("Creating trace forwarder")
-		a.forwarder, err = NewForwarder(a.collectorURL)
+		forwarder, err := NewForwarder(a.collectorURL)
 		if err != nil {
 			fmt.Printf("%v", err)
 			os.Exit(1)
 		}
-		a.forwarder.Start()
-		defer a.forwarder.Stop()
-	} else {
-		a.forwarder = nil
+		forwarder.Breaker = a.newCircuitBreaker("collector")
+		a.destinations = append(a.destinations, forwarder)
+	}
+	if a.kafkaBrokers != "" {
+		logrus.WithField("kafkaBrokers", a.kafkaBrokers).Debug("Creating kafka forwarder")
+		kafkaForwarder, err := NewKafkaForwarder(a.kafkaBrokers, a.kafkaTopic)
+		if err != nil {
+			fmt.Printf("%v", err)
+			os.Exit(1)
+		}
+		kafkaForwarder.Encoding = a.kafkaEncoding
+		kafkaForwarder.Compression = a.kafkaCompression
+		kafkaForwarder.Acks = a.kafkaAcks
+		kafkaForwarder.Breaker = a.newCircuitBreaker(kafkaForwarder.Name)
+		a.destinations = append(a.destinations, kafkaForwarder)
+	}
+	if a.honeycombDataset != "" {
+		logrus.WithField("honeycombDataset", a.honeycombDataset).Debug("Creating honeycomb forwarder")
+		honeycombForwarder, err := NewHoneycombForwarder(a.honeycombAPIHost, a.honeycombDataset, a.honeycombWriteKey)
+		if err != nil {
+			fmt.Printf("%v", err)
+			os.Exit(1)
+		}
+		honeycombForwarder.BatchSize = a.honeycombBatchSize
+		honeycombForwarder.BatchTimeout = a.honeycombBatchTimeout
+		honeycombForwarder.MaxRetries = a.honeycombRetries
+		honeycombForwarder.Breaker = a.newCircuitBreaker(honeycombForwarder.Name)
+		a.destinations = append(a.destinations, honeycombForwarder)
+	}
+	if a.mirrorURL != "" {
+		logrus.WithField("mirrorURL", a.mirrorURL).Debug("Creating mirror")
+		a.mirror, err = NewMirror(a.mirrorURL)
+		if err != nil {
+			fmt.Printf("%v", err)
+			os.Exit(1)
+		}
+		a.mirror.Breaker = a.newCircuitBreaker(a.mirror.Name)
+		a.mirror.Start()
+	}
+	for _, destination := range a.destinations {
+		if err := destination.Start(); err != nil {
+			fmt.Printf("Error starting destination: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if a.decisionLog != nil {
+		a.decisionLog.Start()
 	}
 	err = a.start()
 	if err != nil {
@@ -337,10 +482,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%d", a.metricsPort), nil)
-	defer a.stop()
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.HandleFunc("/admin/reload", a.handleReload)
+	metricsMux.HandleFunc("/admin/flush", a.handleFlush)
+	metricsMux.HandleFunc("/admin/traces/", a.handleTraceAction)
+	metricsMux.HandleFunc("/debug/evaluate", a.handleEvaluate)
+	metricsMux.HandleFunc("/debug/traces", a.handleTraces)
+	metricsMux.HandleFunc("/debug/traces/", a.handleTrace)
+	metricsMux.HandleFunc("/debug/decisions", a.handleDecisionTail)
+	a.metricsServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.metricsPort),
+		Handler: metricsMux,
+	}
+	go a.metricsServer.ListenAndServe()
 	waitForSignal()
+	a.shutdown()
 }
 
 func waitForSignal() {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+// recordingDestination keeps every payload sent to it, or
+// fails every send while err is set
+type recordingDestination struct {
+	payloads []payload
+	err      error
+}
+
+func (d *recordingDestination) Start() error { return nil }
+func (d *recordingDestination) Stop() error  { return nil }
+func (d *recordingDestination) Circuit() *CircuitBreaker {
+	return NewCircuitBreaker("recording", 1, time.Minute)
+}
+func (d *recordingDestination) Send(p payload) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.payloads = append(d.payloads, p)
+	return nil
+}
+
+func newTestApp(t *testing.T, sampleRate int) (*app, *recordingDestination) {
+	policy := fmt.Sprintf(`package otre
+
+response = {"sampleRate": %d, "reason": "test policy"}`, sampleRate)
+	re, err := rules.NewRulesEngine(policy)
+	if err != nil {
+		t.Fatalf("Couldn't create rules engine: %v", err)
+	}
+	destination := new(recordingDestination)
+	a := &app{
+		flushAge:           time.Minute,
+		abandonAge:         5 * time.Minute,
+		flushTimeout:       10 * time.Minute,
+		shutdownIncomplete: "evaluate",
+		traceBuffer:        traces.NewTraceBuffer(),
+		re:                 re,
+		destinations:       []Destination{destination},
+		reasonLabels:       newLabelLimiter(10),
+		shadowReasonLabels: newLabelLimiter(10),
+		serviceLabels:      newLabelLimiter(10),
+	}
+	return a, destination
+}
+
+func addTestTrace(a *app, traceID string, timestamp time.Time, complete bool) {
+	parentID := ""
+	if !complete {
+		parentID = "missing"
+	}
+	a.traceBuffer.AddSpan(types.Span{
+		CoreSpanMetadata:  types.CoreSpanMetadata{TraceID: traceID, ID: traceID + "-root", ParentID: parentID},
+		Timestamp:         timestamp,
+		BinaryAnnotations: map[string]interface{}{},
+	})
+}
+
+func TestProcessSpans(t *testing.T) {
+	a, destination := newTestApp(t, 100)
+	now := time.Now()
+	addTestTrace(a, "old", now.Add(-2*time.Minute), true)
+	addTestTrace(a, "recent", now, true)
+	addTestTrace(a, "incomplete", now.Add(-2*time.Minute), false)
+	addTestTrace(a, "abandoned", now.Add(-6*time.Minute), false)
+
+	destination.err = errors.New("sink full")
+	a.processSpans()
+	if a.traceBuffer.Len() != 4 {
+		t.Errorf("Traces that couldn't be sent should stay in the buffer, %d traces left", a.traceBuffer.Len())
+	}
+
+	destination.err = nil
+	a.processSpans()
+	if len(destination.payloads) != 2 {
+		t.Errorf("Old complete and abandoned traces should be sent once, %d traces sent", len(destination.payloads))
+	}
+	if a.traceBuffer.Len() != 2 {
+		t.Errorf("Sent traces should be removed from the buffer, %d traces left", a.traceBuffer.Len())
+	}
+
+	a.processSpans()
+	if len(destination.payloads) != 2 {
+		t.Errorf("Traces should not be resent once sent, %d traces sent", len(destination.payloads))
+	}
+}
+
+func TestProcessSpansTraceTooLarge(t *testing.T) {
+	a, destination := newTestApp(t, 100)
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	destination.err = errTraceTooLarge
+	a.processSpans()
+	if a.traceBuffer.Len() != 0 {
+		t.Errorf("A trace too large for a destination should not be kept for retry, %d traces left", a.traceBuffer.Len())
+	}
+}
+
+func TestProcessSpansRejected(t *testing.T) {
+	a, destination := newTestApp(t, 0)
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	if len(destination.payloads) != 0 || a.traceBuffer.Len() != 0 {
+		t.Errorf("Rejected traces should be removed from the buffer without being sent")
+	}
+}
+
+func TestFlushTraces(t *testing.T) {
+	for policy, expected := range map[string]int{"accept": 2, "reject": 1, "evaluate": 2} {
+		a, destination := newTestApp(t, 100)
+		a.shutdownIncomplete = policy
+		now := time.Now()
+		addTestTrace(a, "recent", now, true)
+		addTestTrace(a, "incomplete", now, false)
+		a.flushTraces()
+		if len(destination.payloads) != expected {
+			t.Errorf("With %s policy for incomplete traces, expected %d traces sent at shutdown, got %d", policy, expected, len(destination.payloads))
+		}
+		if a.traceBuffer.Len() != 0 {
+			t.Errorf("Buffer should be empty after flushing at shutdown, %d traces left", a.traceBuffer.Len())
+		}
+	}
+	if err := validShutdownIncomplete("drop"); err == nil {
+		t.Errorf("Unknown policy for incomplete traces at shutdown should return an error")
+	}
+}
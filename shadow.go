@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/willthames/otre/decisionlog"
+	"github.com/willthames/otre/rules"
+)
+
+var (
+	shadowEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_shadow_evaluations_total",
+		Help: "The total number of traces evaluated against the shadow policy, by whether its decision agreed with the active policy",
+	}, []string{"agreement"})
+	shadowAcceptedTraces = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_shadow_accepted_traces_total",
+		Help: "The total number of traces the active and shadow policies would accept, by policy and reason",
+	}, []string{"policy", "reason"})
+	shadowAcceptedSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otre_shadow_accepted_spans_total",
+		Help: "The total number of spans the active and shadow policies would accept, by policy and reason",
+	}, []string{"policy", "reason"})
+)
+
+// loadShadowPolicy loads the shadow policy file, replacing the shadow
+// policy if it has changed. If the new policy fails to load, the current
+// shadow policy stays in use, and the error is kept so that the same
+// policy isn't compiled again
+func (a *app) loadShadowPolicy() error {
+	policy, err := rules.LoadPolicy(a.shadowPolicyFile)
+	if err != nil {
+		a.shadowError, a.shadowFailedHash = err, ""
+		return err
+	}
+	hash := policy.Hash()
+	if hash == a.shadowHash {
+		a.shadowError, a.shadowFailedHash = nil, ""
+		return nil
+	}
+	if hash == a.shadowFailedHash {
+		return a.shadowError
+	}
+	if a.shadow == nil {
+		a.shadow, err = rules.NewInputRulesEngine(policy, a.policyInput)
+		if err == nil {
+			a.configureEngine(a.shadow, "shadow")
+		}
+	} else {
+		err = a.shadow.Reload(policy)
+	}
+	if err != nil {
+		a.shadowError, a.shadowFailedHash = err, hash
+		return err
+	}
+	a.shadowHash = hash
+	a.shadowError, a.shadowFailedHash = nil, ""
+	logrus.WithField("shadowPolicy", a.shadowPolicyFile).WithField("sha256", hash).Info("Loaded shadow policy")
+	return nil
+}
+
+// recordAccepted counts a trace accepted by a policy, limiting the
+// reason labels as for decision metrics. Each policy has its own
+// limiter, so that shadow reasons never crowd out active ones
+func (a *app) recordAccepted(policy string, labels *labelLimiter, result *rules.SampleResult, spans int) {
+	reason := labels.value(result.Reason)
+	shadowAcceptedTraces.WithLabelValues(policy, reason).Inc()
+	shadowAcceptedSpans.WithLabelValues(policy, reason).Add(float64(spans))
+}
+
+// evaluateShadow evaluates a trace against the shadow policy using the
+// same random draw as the active policy, so that the two decisions only
+// differ where the policies do. The shadow decision is never acted on.
+// It returns the shadow decision for a sample of disagreements, to be
+// written to the decision log, and nil otherwise
+func (a *app) evaluateShadow(spans []types.Span, draw int, decision bool, result *rules.SampleResult) *decisionlog.ShadowDecision {
+	shadowResult := a.shadow.Evaluate(spans)
+	shadowDecision := shadowResult.Accept(draw)
+	if decision {
+		a.recordAccepted("active", a.reasonLabels, result, len(spans))
+	}
+	if shadowDecision {
+		a.recordAccepted("shadow", a.shadowReasonLabels, shadowResult, len(spans))
+	}
+	if decision == shadowDecision {
+		shadowEvaluations.WithLabelValues("agree").Inc()
+		return nil
+	}
+	shadowEvaluations.WithLabelValues("disagree").Inc()
+	if rand.Float64() >= a.shadowLogSample {
+		return nil
+	}
+	return &decisionlog.ShadowDecision{
+		Decision:   shadowDecision,
+		Reason:     shadowResult.Reason,
+		SampleRate: shadowResult.SampleRate,
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/willthames/otre/rules"
+)
+
+func TestShadowPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shadowFile := path.Join(dir, "shadow.rego")
+	ioutil.WriteFile(shadowFile, []byte("package otre\n\nresponse = {\"sampleRate\": 0, \"reason\": \"shadow\"}\n"), 0644)
+
+	a, destination := newTestApp(t, 100)
+	a.shadowPolicyFile = shadowFile
+	if err := a.loadShadowPolicy(); err != nil {
+		t.Fatalf("Couldn't load shadow policy: %v", err)
+	}
+	agree := testutil.ToFloat64(shadowEvaluations.WithLabelValues("agree"))
+	disagree := testutil.ToFloat64(shadowEvaluations.WithLabelValues("disagree"))
+	activeSpans := testutil.ToFloat64(shadowAcceptedSpans.WithLabelValues("active", "test policy"))
+
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	if len(destination.payloads) != 1 {
+		t.Errorf("Shadow policy should not affect decisions, %d traces sent", len(destination.payloads))
+	}
+	if testutil.ToFloat64(shadowEvaluations.WithLabelValues("disagree")) != disagree+1 {
+		t.Errorf("Rejection by the shadow policy should count as a disagreement")
+	}
+	if testutil.ToFloat64(shadowAcceptedSpans.WithLabelValues("active", "test policy")) != activeSpans+1 {
+		t.Errorf("Spans accepted by the active policy should be counted by reason")
+	}
+
+	ioutil.WriteFile(shadowFile, []byte("package otre\n\nresponse = {\"sampleRate\": 100, \"reason\": \"shadow\"}\n"), 0644)
+	ioutil.WriteFile(shadowFile+".bad", []byte("package otre\n\nresponse = {"), 0644)
+	if err := a.loadShadowPolicy(); err != nil {
+		t.Fatalf("Couldn't reload shadow policy: %v", err)
+	}
+	shadowTraces := testutil.ToFloat64(shadowAcceptedTraces.WithLabelValues("shadow", "shadow"))
+	addTestTrace(a, "another", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+	if testutil.ToFloat64(shadowEvaluations.WithLabelValues("agree")) != agree+1 {
+		t.Errorf("Acceptance by both policies should count as an agreement")
+	}
+	if testutil.ToFloat64(shadowAcceptedTraces.WithLabelValues("shadow", "shadow")) != shadowTraces+1 {
+		t.Errorf("Traces accepted by the shadow policy should be counted by reason")
+	}
+
+	a.shadowPolicyFile = shadowFile + ".bad"
+	if err := a.loadShadowPolicy(); err == nil || a.shadow == nil {
+		t.Errorf("Invalid shadow policy should return an error and keep the current shadow policy")
+	}
+
+	ioutil.WriteFile(shadowFile+".bad", []byte("package otre\n\nresponse = x\n"), 0644)
+	err = a.loadShadowPolicy()
+	if err == nil || a.shadowFailedHash == "" {
+		t.Fatalf("Shadow policy that fails to compile should return an error and be remembered")
+	}
+	if again := a.loadShadowPolicy(); again == nil || again.Error() != err.Error() || a.shadowError == nil {
+		t.Errorf("Unchanged shadow policy that failed to compile should not be compiled again, got %v", again)
+	}
+	a.shadowPolicyFile = shadowFile
+	if err := a.loadShadowPolicy(); err != nil || a.shadowError != nil || a.shadowFailedHash != "" {
+		t.Errorf("Loading a valid shadow policy should clear the previous error, got %v", err)
+	}
+}
+
+func TestShadowReasonLabels(t *testing.T) {
+	a := &app{reasonLabels: newLabelLimiter(1), shadowReasonLabels: newLabelLimiter(1)}
+	others := testutil.ToFloat64(shadowAcceptedTraces.WithLabelValues("shadow", otherLabel))
+	a.recordAccepted("shadow", a.shadowReasonLabels, &rules.SampleResult{Reason: "first reason"}, 1)
+	a.recordAccepted("shadow", a.shadowReasonLabels, &rules.SampleResult{Reason: "trace 1234 is slow"}, 1)
+	if got := testutil.ToFloat64(shadowAcceptedTraces.WithLabelValues("shadow", otherLabel)) - others; got != 1 {
+		t.Errorf("Reasons beyond the limit should be counted as %s, got %v", otherLabel, got)
+	}
+	if reason := a.reasonLabels.value("active reason"); reason != "active reason" {
+		t.Errorf("Shadow reasons should not use up the active policy's reason labels, got %s", reason)
+	}
+}
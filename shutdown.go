@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/traces"
+)
+
+const shutdownReason = "trace incomplete at shutdown"
+
+// finalDecision makes a decision on a trace regardless of its age.
+// Complete traces are checked against the policy as normal, while
+// incomplete traces are accepted, rejected or evaluated according to
+// the shutdownIncomplete setting. It always returns true as there
+// will be no later chance to send the trace
+func (a *app) finalDecision(trace *traces.Trace, now time.Time) bool {
+	_, result := trace.Sample()
+	switch {
+	case result != nil:
+		if !a.sendTrace(trace, acceptedCounter(trace)) {
+			timedOutTraces.Inc()
+		}
+	case trace.IsComplete():
+		a.evaluateTrace(trace)
+	case a.shutdownIncomplete == "accept":
+		result := &rules.SampleResult{SampleRate: 100, Reason: shutdownReason}
+		a.logOverride(trace, true, result)
+		a.acceptTrace(trace, result, incompleteTraces)
+	case a.shutdownIncomplete == "reject":
+		a.logOverride(trace, false, &rules.SampleResult{SampleRate: 0, Reason: shutdownReason})
+		a.recordDecision(trace, false, shutdownReason)
+		logrus.WithField("trace", trace).Debug("dropping incomplete trace at shutdown")
+		rejectedTraces.Inc()
+	default:
+		a.evaluateTrace(trace)
+	}
+	return true
+}
+
+// flushTraces makes a final decision on every trace in the buffer
+func (a *app) flushTraces() {
+	a.processTraces(a.finalDecision)
+}
+
+// validShutdownIncomplete checks the policy for incomplete traces at shutdown
+func validShutdownIncomplete(policy string) error {
+	switch policy {
+	case "accept", "reject", "evaluate":
+		return nil
+	}
+	return fmt.Errorf("invalid shutdown-incomplete policy %s, must be accept, reject or evaluate", policy)
+}
+
+// shutdown stops accepting spans and admin requests, makes a final
+// decision on every buffered trace and then drains the destinations. If
+// this takes longer than shutdownTimeout, any remaining traces are
+// abandoned
+func (a *app) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logrus.Info("Shutting down: no longer accepting spans")
+		if err := a.stop(ctx); err != nil {
+			logrus.WithError(err).Warn("Error stopping server")
+		}
+		// admin requests could otherwise decide on traces during the
+		// final flush, or after the decision log is stopped
+		if a.metricsServer != nil {
+			if err := a.metricsServer.Shutdown(ctx); err != nil {
+				logrus.WithError(err).Warn("Error stopping metrics server")
+			}
+		}
+		if a.mirror != nil {
+			a.mirror.Stop()
+		}
+		if a.capture != nil {
+			a.capture.Close()
+		}
+		logrus.WithField("traces", a.traceBuffer.Len()).Info("Shutting down: flushing trace buffer")
+		a.flushTraces()
+		if a.decisionLog != nil {
+			a.decisionLog.Stop()
+		}
+		logrus.Info("Shutting down: draining destinations")
+		for _, destination := range a.destinations {
+			destination.Stop()
+		}
+	}()
+
+	select {
+	case <-done:
+		logrus.Info("Shutdown complete")
+	case <-ctx.Done():
+		logrus.WithField("shutdownTimeout", a.shutdownTimeout).Warn("Shutdown timed out, abandoning remaining traces")
+	}
+}
@@ -0,0 +1,130 @@
+// Package summary computes properties of a trace from its spans, for use
+// as policy input and by the trace buffer
+package summary
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Summary describes a trace as a whole. DurationMs is the time from the
+// start of the earliest span to the finish of the latest. Depth counts
+// from 0 for a span with no parent in the trace, and Complete is false
+// if any span's parent is missing from the trace
+type Summary struct {
+	Root         *types.Span `json:"root,omitempty"`
+	DurationMs   float64     `json:"durationMs"`
+	SpanCount    int         `json:"spanCount"`
+	Services     []string    `json:"services"`
+	ErrorCount   int         `json:"errorCount"`
+	MaxDepth     int         `json:"maxDepth"`
+	Complete     bool        `json:"complete"`
+	MissingSpans []string    `json:"missingSpans"`
+}
+
+// Input is the structured policy input for a trace
+type Input struct {
+	Spans   []types.Span `json:"spans"`
+	Summary *Summary     `json:"summary"`
+	Tree    *Tree        `json:"tree"`
+}
+
+// NewInput creates the structured policy input for a trace's spans
+func NewInput(spans []types.Span) *Input {
+	if spans == nil {
+		spans = []types.Span{}
+	}
+	tree := NewTree(spans)
+	return &Input{Spans: spans, Summary: summarize(spans, tree), Tree: tree}
+}
+
+// Finish returns the time a span finished
+func Finish(span types.Span) time.Time {
+	return span.Timestamp.Add(time.Duration(int64(span.DurationMs * 1e6)))
+}
+
+// statusCodeTags are the tags that may hold a span's HTTP status code:
+// Zipkin's and older OpenTelemetry conventions, then current OpenTelemetry
+var statusCodeTags = []string{"http.status_code", "http.response.status_code"}
+
+// StatusCode returns the HTTP status code of a span, which may be
+// recorded as a number, a string or a status line such as "200 OK"
+func StatusCode(span types.Span) (int, bool) {
+	for _, tag := range statusCodeTags {
+		value, ok := span.BinaryAnnotations[tag]
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(fmt.Sprint(value))
+		if len(fields) == 0 {
+			continue
+		}
+		if code, err := strconv.Atoi(fields[0]); err == nil {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// DurationMs returns the time in ms from the start of the earliest
+// span to the finish of the latest
+func DurationMs(spans []types.Span) float64 {
+	var start, finish time.Time
+	for i, span := range spans {
+		if i == 0 || span.Timestamp.Before(start) {
+			start = span.Timestamp
+		}
+		if i == 0 || Finish(span).After(finish) {
+			finish = Finish(span)
+		}
+	}
+	return finish.Sub(start).Seconds() * 1000
+}
+
+// IsError returns whether a span records an error, either with an error
+// tag that isn't false or an HTTP status code of 500 or more
+func IsError(span types.Span) bool {
+	if value, ok := span.BinaryAnnotations["error"]; ok && value != false && value != "false" {
+		return true
+	}
+	code, ok := StatusCode(span)
+	return ok && code >= 500
+}
+
+// Summarize computes the summary of a trace's spans
+func Summarize(spans []types.Span) *Summary {
+	return summarize(spans, NewTree(spans))
+}
+
+func summarize(spans []types.Span, tree *Tree) *Summary {
+	s := &Summary{SpanCount: len(spans), Services: []string{}, MissingSpans: []string{}, MaxDepth: tree.MaxDepth()}
+	services := make(map[string]bool)
+	missing := make(map[string]bool)
+	for i, span := range spans {
+		if span.ServiceName != "" && !services[span.ServiceName] {
+			services[span.ServiceName] = true
+			s.Services = append(s.Services, span.ServiceName)
+		}
+		if IsError(span) {
+			s.ErrorCount++
+		}
+		if span.ParentID == "" {
+			if s.Root == nil || span.Timestamp.Before(s.Root.Timestamp) {
+				s.Root = &spans[i]
+			}
+		} else if _, ok := tree.Nodes[span.ParentID]; !ok && !missing[span.ParentID] {
+			missing[span.ParentID] = true
+			s.MissingSpans = append(s.MissingSpans, span.ParentID)
+		}
+	}
+	sort.Strings(s.Services)
+	sort.Strings(s.MissingSpans)
+	s.Complete = len(s.MissingSpans) == 0
+	s.DurationMs = DurationMs(spans)
+	return s
+}
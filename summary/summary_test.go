@@ -0,0 +1,45 @@
+package summary
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+func testSpan(id, parentID, service string, offsetMs, durationMs float64, tags map[string]interface{}) types.Span {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return types.Span{
+		CoreSpanMetadata:  types.CoreSpanMetadata{TraceID: "trace", ID: id, ParentID: parentID, Name: id, ServiceName: service, DurationMs: durationMs},
+		Timestamp:         start.Add(time.Duration(offsetMs * 1e6)),
+		BinaryAnnotations: tags,
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	spans := []types.Span{
+		testSpan("child", "root", "api", 10, 100, map[string]interface{}{"http.status_code": "503"}),
+		testSpan("root", "", "web", 0, 150, map[string]interface{}{"http.status_code": 200}),
+		testSpan("grandchild", "child", "db", 20, 300, map[string]interface{}{"error": true}),
+		testSpan("orphan", "missing", "api", 30, 10, map[string]interface{}{"error": "false"}),
+	}
+	s := Summarize(spans)
+	if s.Root == nil || s.Root.ID != "root" {
+		t.Errorf("Expected root span to be found, got %v", s.Root)
+	}
+	if s.DurationMs != 320 || s.SpanCount != 4 || s.ErrorCount != 2 || s.MaxDepth != 2 {
+		t.Errorf("Expected duration 320, 4 spans, 2 errors and depth 2, got %+v", s)
+	}
+	if !reflect.DeepEqual(s.Services, []string{"api", "db", "web"}) {
+		t.Errorf("Expected sorted services, got %v", s.Services)
+	}
+	if s.Complete || !reflect.DeepEqual(s.MissingSpans, []string{"missing"}) {
+		t.Errorf("Expected trace to be incomplete with one missing span, got %v", s.MissingSpans)
+	}
+
+	empty := NewInput(nil)
+	if empty.Spans == nil || empty.Summary.Root != nil || !empty.Summary.Complete || empty.Summary.DurationMs != 0 {
+		t.Errorf("Expected an empty summary for no spans, got %+v", empty.Summary)
+	}
+}
@@ -0,0 +1,223 @@
+package summary
+
+import (
+	"sort"
+	"time"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+// Node is a span's place in a trace's span tree. Index is the position
+// of the span in the trace's spans, Children are ordered by start time,
+// and SelfTimeMs is the part of the span's duration not covered by any
+// of its children
+type Node struct {
+	ID             string   `json:"id"`
+	Index          int      `json:"index"`
+	ParentID       string   `json:"parentId,omitempty"`
+	Children       []string `json:"children"`
+	Depth          int      `json:"depth"`
+	SelfTimeMs     float64  `json:"selfTimeMs"`
+	OnCriticalPath bool     `json:"onCriticalPath"`
+}
+
+// Tree is the parent/child tree of a trace's spans. Roots are the spans
+// with no parent in the trace, which for a complete trace is just the
+// root span. CriticalPath lists, in order of start time, the spans that
+// determine when the earliest root finishes: those the trace would wait
+// on if each span waited for all its children
+type Tree struct {
+	Nodes        map[string]*Node `json:"nodes"`
+	Roots        []string         `json:"roots"`
+	CriticalPath []string         `json:"criticalPath"`
+
+	spans []types.Span
+}
+
+// NewTree builds the span tree of a trace
+func NewTree(spans []types.Span) *Tree {
+	t := &Tree{Nodes: make(map[string]*Node, len(spans)), Roots: []string{}, CriticalPath: []string{}, spans: spans}
+	for i, span := range spans {
+		t.Nodes[span.ID] = &Node{ID: span.ID, Index: i, ParentID: span.ParentID, Children: []string{}}
+	}
+	for i, span := range spans {
+		if t.Nodes[span.ID].Index != i {
+			continue // a duplicate of a later span
+		}
+		if parent, ok := t.Nodes[span.ParentID]; ok && span.ParentID != span.ID {
+			parent.Children = append(parent.Children, span.ID)
+		} else {
+			t.Roots = append(t.Roots, span.ID)
+		}
+	}
+	t.sortByStart(t.Roots)
+	for _, node := range t.Nodes {
+		t.sortByStart(node.Children)
+		node.SelfTimeMs = t.selfTime(node)
+	}
+	for _, root := range t.Roots {
+		t.setDepth(root, 0)
+	}
+	if root := t.root(); root != nil {
+		t.markCriticalPath(root, Finish(t.span(root)))
+		for id, node := range t.Nodes {
+			if node.OnCriticalPath {
+				t.CriticalPath = append(t.CriticalPath, id)
+			}
+		}
+		t.sortByStart(t.CriticalPath)
+	}
+	return t
+}
+
+// root returns the earliest span with no parent ID, or failing that
+// the earliest span whose parent is missing from the trace
+func (t *Tree) root() *Node {
+	for _, id := range t.Roots {
+		if t.Nodes[id].ParentID == "" {
+			return t.Nodes[id]
+		}
+	}
+	if len(t.Roots) > 0 {
+		return t.Nodes[t.Roots[0]]
+	}
+	return nil
+}
+
+// Descendants returns the IDs of the spans below a span in the tree,
+// depth first with each span's children in order of start time. Spans
+// whose parent IDs form a cycle are each listed once
+func (t *Tree) Descendants(id string) []string {
+	descendants := []string{}
+	seen := map[string]bool{id: true}
+	var walk func(string)
+	walk = func(id string) {
+		node, ok := t.Nodes[id]
+		if !ok {
+			return
+		}
+		for _, child := range node.Children {
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			descendants = append(descendants, child)
+			walk(child)
+		}
+	}
+	walk(id)
+	return descendants
+}
+
+// Span returns the span with the given ID
+func (t *Tree) Span(id string) (types.Span, bool) {
+	node, ok := t.Nodes[id]
+	if !ok {
+		return types.Span{}, false
+	}
+	return t.span(node), true
+}
+
+// MaxDepth returns the depth of the deepest span in the tree
+func (t *Tree) MaxDepth() int {
+	max := 0
+	for _, node := range t.Nodes {
+		if node.Depth > max {
+			max = node.Depth
+		}
+	}
+	return max
+}
+
+func (t *Tree) span(node *Node) types.Span {
+	return t.spans[node.Index]
+}
+
+// sortByStart sorts span IDs by start time, then ID. Parentless spans
+// come first among spans starting at the same time
+func (t *Tree) sortByStart(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := t.span(t.Nodes[ids[i]]), t.span(t.Nodes[ids[j]])
+		switch {
+		case !a.Timestamp.Equal(b.Timestamp):
+			return a.Timestamp.Before(b.Timestamp)
+		case (a.ParentID == "") != (b.ParentID == ""):
+			return a.ParentID == ""
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+// setDepth sets the depth of a node and its descendants
+func (t *Tree) setDepth(id string, depth int) {
+	node := t.Nodes[id]
+	node.Depth = depth
+	for _, child := range node.Children {
+		t.setDepth(child, depth+1)
+	}
+}
+
+// selfTime returns the time in ms a span spends outside all of its
+// children, counting time covered by concurrent children only once
+func (t *Tree) selfTime(node *Node) float64 {
+	span := t.span(node)
+	start, finish := span.Timestamp, Finish(span)
+	type interval struct{ start, finish time.Time }
+	intervals := []interval{}
+	for _, id := range node.Children {
+		child := t.span(t.Nodes[id])
+		i := interval{child.Timestamp, Finish(child)}
+		if i.start.Before(start) {
+			i.start = start
+		}
+		if i.finish.After(finish) {
+			i.finish = finish
+		}
+		if i.finish.After(i.start) {
+			intervals = append(intervals, i)
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+	var covered time.Duration
+	var end time.Time
+	for _, i := range intervals {
+		if i.start.Before(end) {
+			i.start = end
+		}
+		if i.finish.After(i.start) {
+			covered += i.finish.Sub(i.start)
+			end = i.finish
+		}
+	}
+	return (finish.Sub(start) - covered).Seconds() * 1000
+}
+
+// markCriticalPath marks a node as on the critical path, then works back
+// from cursor, the node's finish, through its children: the child
+// finishing last before the cursor is on the critical path, and the
+// cursor moves to its start. Children finishing after the node are
+// treated as finishing with it, to allow for clock skew
+func (t *Tree) markCriticalPath(node *Node, cursor time.Time) {
+	node.OnCriticalPath = true
+	finish := cursor
+	childFinish := func(id string) time.Time {
+		f := Finish(t.span(t.Nodes[id]))
+		if f.After(finish) {
+			return finish
+		}
+		return f
+	}
+	children := make([]string, len(node.Children))
+	copy(children, node.Children)
+	sort.SliceStable(children, func(i, j int) bool { return childFinish(children[i]).After(childFinish(children[j])) })
+	for _, id := range children {
+		child := t.Nodes[id]
+		if childFinish(id).After(cursor) || child.OnCriticalPath {
+			continue
+		}
+		t.markCriticalPath(child, childFinish(id))
+		if start := t.span(child).Timestamp; start.Before(cursor) {
+			cursor = start
+		}
+	}
+}
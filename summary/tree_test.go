@@ -0,0 +1,71 @@
+package summary
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
+)
+
+func TestTree(t *testing.T) {
+	spans := []types.Span{
+		testSpan("late", "root", "api", 95, 25, nil),
+		testSpan("fast", "root", "api", 10, 30, nil),
+		testSpan("query", "slow", "db", 30, 30, nil),
+		testSpan("root", "", "web", 0, 100, nil),
+		testSpan("slow", "root", "db", 20, 70, nil),
+		testSpan("commit", "slow", "db", 50, 35, nil),
+	}
+	tree := NewTree(spans)
+	if !reflect.DeepEqual(tree.Roots, []string{"root"}) {
+		t.Errorf("Expected a single root, got %v", tree.Roots)
+	}
+	root := tree.Nodes["root"]
+	if !reflect.DeepEqual(root.Children, []string{"fast", "slow", "late"}) || root.Index != 3 {
+		t.Errorf("Expected root's children in order of start time, got %v", root.Children)
+	}
+	for id, depth := range map[string]int{"root": 0, "slow": 1, "commit": 2} {
+		if tree.Nodes[id].Depth != depth {
+			t.Errorf("Expected %s at depth %d, got %d", id, depth, tree.Nodes[id].Depth)
+		}
+	}
+	if tree.MaxDepth() != 2 {
+		t.Errorf("Expected max depth 2, got %d", tree.MaxDepth())
+	}
+	for id, selfTime := range map[string]float64{"root": 15, "slow": 15, "commit": 35} {
+		if tree.Nodes[id].SelfTimeMs != selfTime {
+			t.Errorf("Expected %s self time %v, got %v", id, selfTime, tree.Nodes[id].SelfTimeMs)
+		}
+	}
+	if !reflect.DeepEqual(tree.CriticalPath, []string{"root", "slow", "commit", "late"}) {
+		t.Errorf("Expected critical path through slow and late spans, got %v", tree.CriticalPath)
+	}
+	if tree.Nodes["fast"].OnCriticalPath || !tree.Nodes["commit"].OnCriticalPath {
+		t.Errorf("Expected only critical path spans to be marked")
+	}
+	if descendants := tree.Descendants("slow"); !reflect.DeepEqual(descendants, []string{"query", "commit"}) {
+		t.Errorf("Expected slow's descendants in order of start time, got %v", descendants)
+	}
+
+	orphans := NewTree([]types.Span{testSpan("b", "missing", "api", 10, 5, nil), testSpan("a", "missing", "api", 0, 5, nil)})
+	if !reflect.DeepEqual(orphans.Roots, []string{"a", "b"}) || !reflect.DeepEqual(orphans.CriticalPath, []string{"a"}) {
+		t.Errorf("Expected orphaned spans as roots, got %v and critical path %v", orphans.Roots, orphans.CriticalPath)
+	}
+}
+
+func TestTreeCycle(t *testing.T) {
+	tree := NewTree([]types.Span{
+		testSpan("r", "", "web", 0, 100, nil),
+		testSpan("a", "b", "api", 10, 20, nil),
+		testSpan("b", "a", "api", 20, 20, nil),
+	})
+	if !reflect.DeepEqual(tree.Roots, []string{"r"}) {
+		t.Errorf("Expected spans in a cycle not to be roots, got %v", tree.Roots)
+	}
+	if descendants := tree.Descendants("a"); !reflect.DeepEqual(descendants, []string{"b"}) {
+		t.Errorf("Expected each span in a cycle to be listed once, got %v", descendants)
+	}
+	if descendants := tree.Descendants("r"); len(descendants) != 0 {
+		t.Errorf("Expected no descendants of the root, got %v", descendants)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/willthames/otre/decisionlog"
+)
+
+// tailKeepalive is the interval between keepalive comments sent to
+// clients tailing decisions
+const tailKeepalive = 15 * time.Second
+
+// parseDecisionFilter reads a decision filter from the service, reason
+// and decision query parameters
+func parseDecisionFilter(r *http.Request) (decisionlog.Filter, error) {
+	query := r.URL.Query()
+	filter := decisionlog.Filter{Service: query.Get("service"), Reason: query.Get("reason")}
+	switch query.Get("decision") {
+	case "":
+	case "accepted", "accept", "true":
+		accepted := true
+		filter.Decision = &accepted
+	case "rejected", "reject", "false":
+		accepted := false
+		filter.Decision = &accepted
+	default:
+		return filter, fmt.Errorf("invalid decision %s, must be accepted or rejected", query.Get("decision"))
+	}
+	return filter, nil
+}
+
+// handleDecisionTail handles the /debug/decisions GET endpoint, streaming
+// decisions as server-sent events as they are made. The service, reason
+// and decision query parameters stream only decisions for traces with
+// that root service, with a reason containing reason, or that were
+// accepted or rejected. If the client falls behind, decisions are
+// dropped and the number dropped so far is sent as a dropped event
+func (a *app) handleDecisionTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming is not supported"})
+		return
+	}
+	filter, err := parseDecisionFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	subscription := a.tail.Subscribe(filter, a.tailBuffer)
+	defer a.tail.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(tailKeepalive)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.done:
+			return
+		case decision := <-subscription.C:
+			data, err := json.Marshal(decision)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: decision\ndata: %s\n\n", data)
+		case <-ticker.C:
+			if dropped := subscription.Dropped(); dropped != reported {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+				reported = dropped
+			} else {
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+		}
+		flusher.Flush()
+	}
+}
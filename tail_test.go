@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willthames/otre/decisionlog"
+)
+
+func TestHandleDecisionTail(t *testing.T) {
+	a, _ := newTestApp(t, 100)
+	a.tail = decisionlog.NewTail()
+	a.tailBuffer = 10
+	server := httptest.NewServer(http.HandlerFunc(a.handleDecisionTail))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?decision=invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid decision filter, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "?decision=accepted&reason=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	for a.tail.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	addTestTrace(a, "old", time.Now().Add(-2*time.Minute), true)
+	a.processSpans()
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if lines[0] != "event: decision" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("Expected a decision event, got %v", lines)
+	}
+	var decision decisionlog.Decision
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &decision); err != nil {
+		t.Fatal(err)
+	}
+	if decision.TraceID != "old" || !decision.Decision || decision.Reason != "test policy" {
+		t.Errorf("Expected the decision on the old trace, got %+v", decision)
+	}
+}
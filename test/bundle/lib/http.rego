@@ -0,0 +1,5 @@
+package lib.http
+
+is_ping(span) {
+  endswith(span.binaryAnnotations["http.url"], "/ping")
+}
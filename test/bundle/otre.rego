@@ -0,0 +1,17 @@
+package otre
+
+import data.lib.http
+import data.services
+
+default_rate = data.defaults.sampleRate
+
+response = {"sampleRate": 0, "reason": "URL ending /ping is a ping URL"} {
+  some i
+  http.is_ping(input.spans[i])
+} else = {"sampleRate": rate, "reason": msg} {
+  some i
+  rate := services[input.spans[i].serviceName].sampleRate
+  msg := sprintf("sample rate for service %s", [input.spans[i].serviceName])
+} else = {"sampleRate": default_rate, "reason": "fallback sample rate"} {
+  true
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeycomb-opentracing-proxy/types"
 	"github.com/willthames/otre/rules"
+	"github.com/willthames/otre/summary"
 )
 
 // SpanID is an ID for a span
@@ -24,8 +25,8 @@ type Trace struct {
 	spans   map[SpanID]types.Span
 	sync.RWMutex
 	version        string
-	SampleResult   *rules.SampleResult
-	SampleDecision bool
+	sampleResult   *rules.SampleResult
+	sampleDecision bool
 }
 
 // TraceBufferMetrics returns the net change in spans and traces in a TraceBuffer
@@ -56,6 +57,13 @@ func NewTraceBuffer() *TraceBuffer {
 	return traceBuffer
 }
 
+// Len returns the number of traces in a TraceBuffer
+func (tb *TraceBuffer) Len() int {
+	tb.RLock()
+	defer tb.RUnlock()
+	return len(tb.Traces)
+}
+
 // AddSpan adds a span to a TraceBuffer, creating
 // a new trace if the trace isn't yet in the TraceBuffer
 func (tb *TraceBuffer) AddSpan(span types.Span) TraceBufferMetrics {
@@ -86,6 +94,14 @@ func (tb *TraceBuffer) AddSpan(span types.Span) TraceBufferMetrics {
 	return tbm
 }
 
+// Get returns the trace with the given TraceID, if it is in the TraceBuffer
+func (tb *TraceBuffer) Get(traceID TraceID) (*Trace, bool) {
+	tb.RLock()
+	defer tb.RUnlock()
+	trace, ok := tb.Traces[traceID]
+	return trace, ok
+}
+
 // DeleteTrace deletes a trace from the trace buffer
 func (tb *TraceBuffer) DeleteTrace(traceID TraceID) TraceBufferMetrics {
 	tbm := *new(TraceBufferMetrics)
@@ -118,6 +134,11 @@ func NewTrace(traceID TraceID, spans []types.Span) *Trace {
 	return trace
 }
 
+// ID returns the TraceID of a trace
+func (t *Trace) ID() TraceID {
+	return t.traceID
+}
+
 // MarshalJSON converts a Trace to a JSON string
 func (t *Trace) MarshalJSON() ([]byte, error) {
 	v := make([]string, len(t.spans))
@@ -150,6 +171,50 @@ func (t *Trace) Spans() []types.Span {
 	return v
 }
 
+// CopySpans returns copies of the spans in a trace with their own
+// binary annotations, safe to read while tags are added to the trace
+func (t *Trace) CopySpans() []types.Span {
+	t.RLock()
+	defer t.RUnlock()
+	v := make([]types.Span, 0, len(t.spans))
+	for _, span := range t.spans {
+		annotations := make(map[string]interface{}, len(span.BinaryAnnotations))
+		for k, value := range span.BinaryAnnotations {
+			annotations[k] = value
+		}
+		span.BinaryAnnotations = annotations
+		v = append(v, span)
+	}
+	return v
+}
+
+// Sample returns the sampling decision made on a trace, and its result,
+// which is nil if no decision has been made
+func (t *Trace) Sample() (bool, *rules.SampleResult) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.sampleDecision, t.sampleResult
+}
+
+// SetSample records the sampling decision made on a trace
+func (t *Trace) SetSample(decision bool, result *rules.SampleResult) {
+	t.Lock()
+	defer t.Unlock()
+	t.sampleDecision, t.sampleResult = decision, result
+}
+
+// SpanCount returns the number of spans in a trace
+func (t *Trace) SpanCount() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.spans)
+}
+
+// Tree returns the parent/child tree of the spans in a trace
+func (t *Trace) Tree() *summary.Tree {
+	return summary.NewTree(t.Spans())
+}
+
 // IsComplete checks if all spans in a trace have
 // parents (leaves can potentially be missing but that is impossible
 // to detect)
@@ -190,9 +255,9 @@ func (t *Trace) MissingSpans() []SpanID {
 	return result
 }
 
-// olderThanAbsolute checks whether the most recently completed span
-// is older than an absolute timestamp
-func (t *Trace) olderThanAbsolute(abstime time.Time) bool {
+// LastFinished returns the time the most recently completed
+// span in a trace finished
+func (t *Trace) LastFinished() time.Time {
 	var timestamp, finish time.Time
 	var duration float64
 	maximum := time.Unix(0, 0)
@@ -206,7 +271,13 @@ func (t *Trace) olderThanAbsolute(abstime time.Time) bool {
 			maximum = finish
 		}
 	}
-	return maximum.Before(abstime)
+	return maximum
+}
+
+// olderThanAbsolute checks whether the most recently completed span
+// is older than an absolute timestamp
+func (t *Trace) olderThanAbsolute(abstime time.Time) bool {
+	return t.LastFinished().Before(abstime)
 }
 
 // OlderThanRelative checks whether the most recently completed span
@@ -217,9 +288,15 @@ func (t *Trace) OlderThanRelative(duration time.Duration, now time.Time) bool {
 }
 
 func (t *Trace) rootSpanID() (SpanID, error) {
-	var parentID SpanID
 	t.RLock()
 	defer t.RUnlock()
+	return t.findRootSpanID()
+}
+
+// findRootSpanID returns the ID of the root span. The caller must hold
+// the trace lock
+func (t *Trace) findRootSpanID() (SpanID, error) {
+	var parentID SpanID
 	for spanID, span := range t.spans {
 		parentID = SpanID(span.CoreSpanMetadata.ParentID)
 		if parentID == "" {
@@ -229,19 +306,31 @@ func (t *Trace) rootSpanID() (SpanID, error) {
 	return "", fmt.Errorf("Couldn't find root span")
 }
 
-// AddStringTag adds a key-value binary annotation to a trace
-func (t *Trace) AddStringTag(key string, value string) error {
+// RootSpan returns the span in a trace that has no parent
+func (t *Trace) RootSpan() (types.Span, error) {
 	rootSpanID, err := t.rootSpanID()
 	if err != nil {
-		return err
+		return types.Span{}, err
 	}
-	t.spans[rootSpanID].BinaryAnnotations[key] = value
-	return nil
+	t.RLock()
+	defer t.RUnlock()
+	return t.spans[rootSpanID], nil
+}
+
+// AddStringTag adds a key-value binary annotation to a trace
+func (t *Trace) AddStringTag(key string, value string) error {
+	return t.addTag(key, value)
 }
 
 // AddIntTag adds a key-value binary annotation to a trace
 func (t *Trace) AddIntTag(key string, value int) error {
-	rootSpanID, err := t.rootSpanID()
+	return t.addTag(key, value)
+}
+
+func (t *Trace) addTag(key string, value interface{}) error {
+	t.Lock()
+	defer t.Unlock()
+	rootSpanID, err := t.findRootSpanID()
 	if err != nil {
 		return err
 	}